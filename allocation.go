@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// 费用分摊策略
+const (
+	AllocQuota        = "quota"        // 按额度：总使用量 / 单位额度 × 账号费用
+	AllocProportional = "proportional" // 按使用量占比分摊账号费用
+	AllocEqual        = "equal"        // 账号费用平均分摊
+	AllocTiered       = "tiered"       // 阶梯：额度内按额度计费，超出部分乘以阶梯倍率
+)
+
+// 当前分摊公式的版本，公式或取整方式变化时递增，随费用记录保存
+const AllocationFormulaVersion = 3
+
+// 各版本公式的说明，用于解释历史记录
+var allocationFormulaVersions = map[int]string{
+	1: "固定按额度分摊，费用不取整",
+	2: "可选分摊方式，每人费用四舍五入到分",
+	3: "金额以分为单位，尾差按最大余数分配，每人费用合计等于总额",
+}
+
+// formulaVersionText 公式版本说明
+func formulaVersionText(v int) string {
+	if text, ok := allocationFormulaVersions[v]; ok {
+		return fmt.Sprintf("第 %d 版（%s）", v, text)
+	}
+	return fmt.Sprintf("第 %d 版", v)
+}
+
+// 分摊参数默认值
+const (
+	DefaultUnitQuota      = 2800.0
+	DefaultAmortizeMonths = 12
+	DefaultTierRate       = 1.5
+)
+
+// AllocationParams 一次费用分摊的参数，随费用记录一起保存
+type AllocationParams struct {
+	Strategy       string
+	AccountFee     Cents   // 账号费用
+	ServerFee      Cents   // 服务器费用（按 AmortizeMonths 个月摊销）
+	UnitQuota      float64 // 一份账号费用对应的使用量（按额度 / 阶梯）
+	AmortizeMonths int     // 服务器费用摊销月数
+	TierRate       float64 // 阶梯：超出单位额度部分的费率倍数
+	HeadCount      int     // 分摊服务器费用的人数（包含 admin）
+}
+
+// AllocationResult 单个用户的分摊结果
+type AllocationResult struct {
+	UserID     int     `json:"user_id"`
+	Usage      float64 `json:"usage"`
+	TotalUsage float64 `json:"total_usage"` // 使用量 + 折扣使用量 × 折扣率
+	Cost       Cents   `json:"cost_cents"`  // 取整到分后的费用
+}
+
+// allocationStrategy 一种分摊策略：根据每人的总使用量计算账号费用部分（以分为单位，可含小数）
+type allocationStrategy struct {
+	Name    string
+	Label   string
+	Formula string // 页面上显示的公式说明
+	cost    func(p AllocationParams, usage, total float64, n int) float64
+}
+
+var allocationStrategies = []allocationStrategy{
+	{
+		Name:    AllocQuota,
+		Label:   "按额度",
+		Formula: "用户费用 = 总使用量 / 单位额度 × 账号费用 + 服务器费用 / 摊销月数 / 用户数量",
+		cost: func(p AllocationParams, usage, total float64, n int) float64 {
+			return usage / p.UnitQuota * float64(p.AccountFee)
+		},
+	},
+	{
+		Name:    AllocProportional,
+		Label:   "按使用量占比",
+		Formula: "用户费用 = 账号费用 × 总使用量 / 全部总使用量 + 服务器费用 / 摊销月数 / 用户数量",
+		cost: func(p AllocationParams, usage, total float64, n int) float64 {
+			if total <= 0 {
+				return float64(p.AccountFee) / float64(n)
+			}
+			return float64(p.AccountFee) * usage / total
+		},
+	},
+	{
+		Name:    AllocEqual,
+		Label:   "平均分摊",
+		Formula: "用户费用 = 账号费用 / 参与人数 + 服务器费用 / 摊销月数 / 用户数量",
+		cost: func(p AllocationParams, usage, total float64, n int) float64 {
+			return float64(p.AccountFee) / float64(n)
+		},
+	},
+	{
+		Name:    AllocTiered,
+		Label:   "阶梯",
+		Formula: "额度内：总使用量 / 单位额度 × 账号费用；超出单位额度的部分再乘以阶梯倍率；另加 服务器费用 / 摊销月数 / 用户数量",
+		cost: func(p AllocationParams, usage, total float64, n int) float64 {
+			base := math.Min(usage, p.UnitQuota)
+			over := math.Max(usage-p.UnitQuota, 0)
+			return (base + over*p.TierRate) / p.UnitQuota * float64(p.AccountFee)
+		},
+	},
+}
+
+// findAllocationStrategy 按名称查找分摊策略
+func findAllocationStrategy(name string) (allocationStrategy, bool) {
+	for _, s := range allocationStrategies {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return allocationStrategy{}, false
+}
+
+// allocationLabel 策略名称，用于页面显示
+func allocationLabel(name string) string {
+	if s, ok := findAllocationStrategy(name); ok {
+		return s.Label
+	}
+	return name
+}
+
+// defaultAllocationParams 没有历史记录时的默认分摊参数
+func defaultAllocationParams() AllocationParams {
+	return AllocationParams{
+		Strategy:       AllocQuota,
+		AccountFee:     DefaultAccountFee,
+		ServerFee:      DefaultServerFee,
+		UnitQuota:      DefaultUnitQuota,
+		AmortizeMonths: DefaultAmortizeMonths,
+		TierRate:       DefaultTierRate,
+	}
+}
+
+// Validate 检查参数是否可以用于计算
+func (p AllocationParams) Validate() error {
+	s, ok := findAllocationStrategy(p.Strategy)
+	if !ok {
+		return fmt.Errorf("未知分摊方式: %s", p.Strategy)
+	}
+	if p.AccountFee < 0 || p.ServerFee < 0 {
+		return fmt.Errorf("费用不能为负数")
+	}
+	if p.AmortizeMonths < 1 {
+		return fmt.Errorf("摊销月数至少为 1")
+	}
+	if (s.Name == AllocQuota || s.Name == AllocTiered) && p.UnitQuota <= 0 {
+		return fmt.Errorf("单位额度必须大于 0")
+	}
+	if s.Name == AllocTiered && p.TierRate <= 0 {
+		return fmt.Errorf("阶梯倍率必须大于 0")
+	}
+	return nil
+}
+
+// headCount 分摊服务器费用的人数，未指定时为参与分摊的人数，至少为 1
+func (p AllocationParams) headCount(participants int) int {
+	if p.HeadCount > 0 {
+		return p.HeadCount
+	}
+	if participants > 0 {
+		return participants
+	}
+	return 1
+}
+
+// allocateExpense 按分摊参数计算每个用户的费用，结果按用户 ID 排序，并返回总使用量和费用合计。
+// 计算费用和保存记录共用这一实现。每人的精确金额按 distributeCents 取整到分，合计不会因取整产生误差
+func allocateExpense(p AllocationParams, inputs map[int]UserExpenseInput) ([]AllocationResult, float64, Cents, error) {
+	if err := p.Validate(); err != nil {
+		return nil, 0, 0, err
+	}
+	strategy, _ := findAllocationStrategy(p.Strategy)
+
+	serverShare := float64(p.ServerFee) / float64(p.AmortizeMonths) / float64(p.headCount(len(inputs)))
+
+	var userIDs []int
+	var total float64
+	for userID, input := range inputs {
+		userIDs = append(userIDs, userID)
+		total += input.TotalUsage()
+	}
+	sort.Ints(userIDs)
+
+	exact := make(map[int]float64)
+	for _, userID := range userIDs {
+		exact[userID] = strategy.cost(p, inputs[userID].TotalUsage(), total, len(inputs)) + serverShare
+	}
+	costs, totalCost := distributeCents(userIDs, exact)
+
+	results := make([]AllocationResult, 0, len(userIDs))
+	for _, userID := range userIDs {
+		input := inputs[userID]
+		results = append(results, AllocationResult{
+			UserID:     userID,
+			Usage:      input.Usage,
+			TotalUsage: input.TotalUsage(),
+			Cost:       costs[userID],
+		})
+	}
+	return results, total, totalCost, nil
+}
+
+// ExpenseDiff 重新计算后与记录中费用的对比
+type ExpenseDiff struct {
+	ExpenseUsage
+	Recomputed Cents
+	Diff       Cents // 重新计算 - 记录
+}
+
+// Matches 是否一致
+func (d ExpenseDiff) Matches() bool {
+	return d.Diff == 0
+}
+
+// ExpenseRecompute 用当前代码重新计算一条历史记录的结果
+type ExpenseRecompute struct {
+	Params        AllocationParams
+	HeadInferred  bool // 记录中没有保存人数，由已保存的费用反推
+	VersionChange bool // 记录的公式版本与当前不同
+	Diffs         []ExpenseDiff
+	Mismatches    int
+}
+
+// recomputeExpense 用记录保存的参数和使用量重新计算，逐人对比费用
+func recomputeExpense(record *ExpenseRecord, usages []ExpenseUsage) (*ExpenseRecompute, error) {
+	inputs := make(map[int]UserExpenseInput)
+	for _, u := range usages {
+		inputs[u.UserID] = UserExpenseInput{Usage: u.Usage, DiscountUsage: u.DiscountUsage, DiscountRate: u.DiscountRate}
+	}
+
+	rc := &ExpenseRecompute{Params: record.Params(), VersionChange: record.FormulaVersion != AllocationFormulaVersion}
+	if rc.Params.HeadCount == 0 {
+		if n := inferHeadCount(rc.Params, usages, inputs); n > 0 {
+			rc.Params.HeadCount = n
+			rc.HeadInferred = true
+		}
+	}
+
+	results, _, _, err := allocateExpense(rc.Params, inputs)
+	if err != nil {
+		return nil, err
+	}
+	recomputed := make(map[int]Cents)
+	for _, res := range results {
+		recomputed[res.UserID] = res.Cost
+	}
+	for _, u := range usages {
+		d := ExpenseDiff{ExpenseUsage: u, Recomputed: recomputed[u.UserID]}
+		d.Diff = d.Recomputed - u.CalculatedCost
+		if !d.Matches() {
+			rc.Mismatches++
+		}
+		rc.Diffs = append(rc.Diffs, d)
+	}
+	return rc, nil
+}
+
+// inferHeadCount 旧记录没有保存分摊人数，用第一条费用减去账号费用部分反推服务器费用的分摊人数
+func inferHeadCount(p AllocationParams, usages []ExpenseUsage, inputs map[int]UserExpenseInput) int {
+	if len(usages) == 0 || p.ServerFee <= 0 || p.Validate() != nil {
+		return 0
+	}
+	strategy, _ := findAllocationStrategy(p.Strategy)
+	var total float64
+	for _, in := range inputs {
+		total += in.TotalUsage()
+	}
+	u := usages[0]
+	share := float64(u.CalculatedCost) - strategy.cost(p, inputs[u.UserID].TotalUsage(), total, len(inputs))
+	if share <= 0 {
+		return 0
+	}
+	return int(math.Round(float64(p.ServerFee) / float64(p.AmortizeMonths) / share))
+}
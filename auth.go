@@ -21,6 +21,7 @@ type Session struct {
 	UserID    int
 	Username  string
 	IsAdmin   bool
+	IsLead    bool
 	CreatedAt time.Time
 	ExpiresAt time.Time
 }
@@ -54,6 +55,7 @@ func createSession(w http.ResponseWriter, user *User, rememberMe bool) {
 		UserID:    user.ID,
 		Username:  user.Username,
 		IsAdmin:   user.IsAdmin,
+		IsLead:    user.IsLead,
 		CreatedAt: now,
 		ExpiresAt: expiresAt,
 	}
@@ -140,6 +142,7 @@ func getSession(r *http.Request) *Session {
 		UserID:    user.ID,
 		Username:  user.Username,
 		IsAdmin:   user.IsAdmin,
+		IsLead:    user.IsLead,
 		CreatedAt: time.Now(),
 		ExpiresAt: expiresAt,
 	}
@@ -197,6 +200,16 @@ func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
 	})
 }
 
+// canEditSchedule 本人、管理员和组长可以修改某人的日程
+func canEditSchedule(sess *Session, userID int) bool {
+	return sess.UserID == userID || sess.IsAdmin || sess.IsLead
+}
+
+// needsLeaveApproval 非管理员不能直接标记休息，需要提交请假申请
+func needsLeaveApproval(sess *Session, status int) bool {
+	return status == StatusRest && !sess.IsAdmin
+}
+
 func checkPassword(hashed, password string) bool {
 	return bcrypt.CompareHashAndPassword([]byte(hashed), []byte(password)) == nil
 }
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 提示中最多列出的人数不足条目
+const maxCoverageMessages = 5
+
+// Covers 该规则是否涵盖某用户
+func (s CoverageShortfall) Covers(userID int) bool {
+	return s.members == nil || s.members[userID]
+}
+
+// Message 提示文字，如 “2026-10-16 后端 在岗 1.5 人，少于要求的 2 人”
+func (s CoverageShortfall) Message() string {
+	scope := "全员"
+	if s.Rule.GroupName != "" {
+		scope = s.Rule.GroupName
+	}
+	return fmt.Sprintf("%s %s 在岗 %s 人，少于要求的 %d 人",
+		s.Date, scope, strconv.FormatFloat(s.Working, 'f', -1, 64), s.Rule.MinCount)
+}
+
+// coverageMessage 合并多条人数不足的提示，过多时只列出前几条
+func coverageMessage(list []CoverageShortfall) string {
+	var msgs []string
+	for i, s := range list {
+		if i == maxCoverageMessages {
+			msgs = append(msgs, fmt.Sprintf("等共 %d 处", len(list)))
+			break
+		}
+		msgs = append(msgs, s.Message())
+	}
+	return strings.Join(msgs, "；")
+}
+
+// workingHalves 某人某天计入在岗的人数：不休息的半天各计 0.5
+func workingHalves(am, pm int) float64 {
+	var n float64
+	for _, status := range []int{am, pm} {
+		if !isOffStatus(status) {
+			n += 0.5
+		}
+	}
+	return n
+}
+
+// coverageCounter 按分组统计在岗人数，同一次检查中每个分组只查询一次
+type coverageCounter struct {
+	start, end time.Time
+	groups     map[int]Group
+	counts     map[int]map[string]float64
+}
+
+func newCoverageCounter(start, end time.Time) (*coverageCounter, error) {
+	groups, err := getGroups()
+	if err != nil {
+		return nil, err
+	}
+	c := &coverageCounter{start: start, end: end, groups: make(map[int]Group), counts: make(map[int]map[string]float64)}
+	for _, g := range groups {
+		c.groups[g.ID] = g
+	}
+	return c, nil
+}
+
+// members 规则涵盖的用户，全员规则返回 nil
+func (c *coverageCounter) members(rule CoverageRule) map[int]bool {
+	if rule.GroupID == 0 {
+		return nil
+	}
+	if g, ok := c.groups[rule.GroupID]; ok {
+		return g.MemberIDs
+	}
+	return map[int]bool{}
+}
+
+// working 分组在每一天的在岗人数
+func (c *coverageCounter) working(groupID int) (map[string]float64, error) {
+	if counts, ok := c.counts[groupID]; ok {
+		return counts, nil
+	}
+	users, err := getGroupUsers(groupID)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]float64)
+	for _, u := range users {
+		schedules, err := getSchedulesRange(u.ID, c.start, c.end)
+		if err != nil {
+			return nil, err
+		}
+		for d := c.start; !d.After(c.end); d = d.AddDate(0, 0, 1) {
+			date := d.Format("2006-01-02")
+			am, pm := StatusDefault, StatusDefault
+			if s, ok := schedules[date]; ok {
+				am, pm = s.Halves()
+			}
+			counts[date] += workingHalves(am, pm)
+		}
+	}
+	c.counts[groupID] = counts
+	return counts, nil
+}
+
+// findCoverageShortfalls 日期范围内在岗人数低于规则要求的日期，放假的日期不检查
+func findCoverageShortfalls(start, end time.Time) (map[string][]CoverageShortfall, error) {
+	rules, err := getCoverageRules()
+	if err != nil || len(rules) == 0 {
+		return nil, err
+	}
+	holidays, err := getHolidays(start, end)
+	if err != nil {
+		return nil, err
+	}
+	counter, err := newCoverageCounter(start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string][]CoverageShortfall)
+	for _, rule := range rules {
+		counts, err := counter.working(rule.GroupID)
+		if err != nil {
+			return nil, err
+		}
+		for d := start; !d.After(end); d = d.AddDate(0, 0, 1) {
+			date := d.Format("2006-01-02")
+			if int(d.Weekday()) != rule.Weekday || holidays[date].Kind == HolidayKindHoliday {
+				continue
+			}
+			if counts[date] < float64(rule.MinCount) {
+				result[date] = append(result[date], CoverageShortfall{
+					Date: date, Rule: rule, Working: counts[date], members: counter.members(rule),
+				})
+			}
+		}
+	}
+	return result, nil
+}
+
+// checkCoverage 模拟把某用户在 changes 中各天改为新的上下午状态，
+// 返回会因此低于下限的规则，分为需要拒绝的和只需提醒的。
+// 本来就不足的日期只有人数继续减少时才算
+func checkCoverage(userID int, changes map[string][2]int) (rejected, warned []CoverageShortfall, err error) {
+	if len(changes) == 0 {
+		return nil, nil, nil
+	}
+	rules, err := getCoverageRules()
+	if err != nil || len(rules) == 0 {
+		return nil, nil, err
+	}
+
+	var dates []string
+	for date := range changes {
+		dates = append(dates, date)
+	}
+	sort.Strings(dates)
+	start, err := time.Parse("2006-01-02", dates[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	end, err := time.Parse("2006-01-02", dates[len(dates)-1])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	holidays, err := getHolidays(start, end)
+	if err != nil {
+		return nil, nil, err
+	}
+	current, err := getSchedulesRange(userID, start, end)
+	if err != nil {
+		return nil, nil, err
+	}
+	counter, err := newCoverageCounter(start, end)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, rule := range rules {
+		if members := counter.members(rule); members != nil && !members[userID] {
+			continue
+		}
+		var counts map[string]float64
+		for _, date := range dates {
+			d, _ := time.Parse("2006-01-02", date)
+			if int(d.Weekday()) != rule.Weekday || holidays[date].Kind == HolidayKindHoliday {
+				continue
+			}
+			if counts == nil {
+				if counts, err = counter.working(rule.GroupID); err != nil {
+					return nil, nil, err
+				}
+			}
+
+			am, pm := StatusDefault, StatusDefault
+			if s, ok := current[date]; ok {
+				am, pm = s.Halves()
+			}
+			before := counts[date]
+			after := before - workingHalves(am, pm) + workingHalves(changes[date][0], changes[date][1])
+			if after >= before || after >= float64(rule.MinCount) {
+				continue
+			}
+
+			s := CoverageShortfall{Date: date, Rule: rule, Working: after, members: counter.members(rule)}
+			if rule.Enforce {
+				rejected = append(rejected, s)
+			} else {
+				warned = append(warned, s)
+			}
+		}
+	}
+	return rejected, warned, nil
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
+	"strings"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 	_ "modernc.org/sqlite"
@@ -36,6 +39,140 @@ func initDB(dbPath string) {
 
 	db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_schedules_user_date ON schedules(user_id, date)`)
 
+	// 日程变更记录
+	db.Exec(`CREATE TABLE IF NOT EXISTS schedule_changes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		date TEXT NOT NULL,
+		old_status INTEGER,
+		new_status INTEGER NOT NULL,
+		actor_id INTEGER NOT NULL,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`)
+	db.Exec(`CREATE INDEX IF NOT EXISTS idx_schedule_changes_user_date ON schedule_changes(user_id, date)`)
+
+	// 日程备注，独立于状态，周期规则推导的日期也可以加备注
+	db.Exec(`CREATE TABLE IF NOT EXISTS schedule_notes (
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		date TEXT NOT NULL,
+		note TEXT NOT NULL,
+		updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (user_id, date)
+	)`)
+
+	// 日程评论，parent_id 为 0 表示顶层评论
+	db.Exec(`CREATE TABLE IF NOT EXISTS schedule_comments (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		date TEXT NOT NULL,
+		author_id INTEGER NOT NULL,
+		parent_id INTEGER NOT NULL DEFAULT 0,
+		body TEXT NOT NULL,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`)
+	db.Exec(`CREATE INDEX IF NOT EXISTS idx_schedule_comments_user_date ON schedule_comments(user_id, date)`)
+
+	// 周期性日程规则表
+	db.Exec(`CREATE TABLE IF NOT EXISTS schedule_rules (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		status INTEGER NOT NULL,
+		weekdays INTEGER NOT NULL,
+		interval_weeks INTEGER NOT NULL DEFAULT 1,
+		start_date TEXT NOT NULL,
+		end_date TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`)
+
+	// 请假申请，审批通过后写入休息
+	db.Exec(`CREATE TABLE IF NOT EXISTS leave_requests (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		start_date TEXT NOT NULL,
+		end_date TEXT NOT NULL,
+		reason TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL DEFAULT 'pending',
+		approver_id INTEGER,
+		comment TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		decided_at DATETIME
+	)`)
+	db.Exec(`CREATE INDEX IF NOT EXISTS idx_leave_requests_user ON leave_requests(user_id, status)`)
+
+	// 年假额度，每人每年一条
+	db.Exec(`CREATE TABLE IF NOT EXISTS leave_quotas (
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		year INTEGER NOT NULL,
+		quota REAL NOT NULL,
+		PRIMARY KEY (user_id, year)
+	)`)
+
+	// 值班轮换
+	db.Exec(`CREATE TABLE IF NOT EXISTS rotations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		shift_days INTEGER NOT NULL DEFAULT 7,
+		start_date TEXT NOT NULL,
+		skip_holidays BOOLEAN NOT NULL DEFAULT 0,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`)
+	db.Exec(`CREATE TABLE IF NOT EXISTS rotation_members (
+		rotation_id INTEGER NOT NULL REFERENCES rotations(id),
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		position INTEGER NOT NULL,
+		PRIMARY KEY (rotation_id, user_id)
+	)`)
+	// 生成的值班安排，换班时直接修改 user_id
+	db.Exec(`CREATE TABLE IF NOT EXISTS rotation_shifts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		rotation_id INTEGER NOT NULL REFERENCES rotations(id),
+		user_id INTEGER NOT NULL,
+		date TEXT NOT NULL,
+		UNIQUE (rotation_id, date)
+	)`)
+	db.Exec(`CREATE TABLE IF NOT EXISTS rotation_swaps (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		rotation_id INTEGER NOT NULL REFERENCES rotations(id),
+		requester_id INTEGER NOT NULL,
+		requester_date TEXT NOT NULL,
+		target_id INTEGER NOT NULL,
+		target_date TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		decided_at DATETIME
+	)`)
+
+	// 换班状态不再与请假共用 approved
+	db.Exec(`UPDATE rotation_swaps SET status = 'accepted' WHERE status = 'approved'`)
+
+	// 节假日日历（法定假日 / 调休上班）
+	db.Exec(`CREATE TABLE IF NOT EXISTS holidays (
+		date TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		kind TEXT NOT NULL
+	)`)
+
+	// 日程状态定义表
+	db.Exec(`CREATE TABLE IF NOT EXISTS schedule_statuses (
+		code INTEGER PRIMARY KEY,
+		label TEXT NOT NULL,
+		emoji TEXT NOT NULL DEFAULT '',
+		color TEXT NOT NULL DEFAULT '#f0f0f0',
+		sort_order INTEGER NOT NULL DEFAULT 0,
+		active BOOLEAN NOT NULL DEFAULT 1
+	)`)
+
+	// 内置状态（已存在则保留后台的修改）
+	db.Exec(`INSERT OR IGNORE INTO schedule_statuses (code, label, emoji, color, sort_order) VALUES
+		(1, '默认', '', '#f0f0f0', 0),
+		(2, '休息', '休', '#a8e6cf', 10),
+		(3, '🐮🐴', '🐮🐴', '#ff8a80', 20)`)
+
+	// 添加 is_off 列，首次添加时把内置的“休息”标记为不上班
+	if _, err := db.Exec(`ALTER TABLE schedule_statuses ADD COLUMN is_off BOOLEAN NOT NULL DEFAULT 0`); err == nil {
+		db.Exec(`UPDATE schedule_statuses SET is_off = 1 WHERE code = ?`, StatusRest)
+	}
+
 	// 持久化 session 表（用于"记住我"功能）
 	db.Exec(`CREATE TABLE IF NOT EXISTS sessions (
 		id TEXT PRIMARY KEY,
@@ -44,6 +181,13 @@ func initDB(dbPath string) {
 		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
 	)`)
 
+	// 日历订阅 token（每人一个，可重置或撤销）
+	db.Exec(`CREATE TABLE IF NOT EXISTS feed_tokens (
+		token TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL UNIQUE REFERENCES users(id),
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`)
+
 	// 费用记录表
 	db.Exec(`CREATE TABLE IF NOT EXISTS expense_records (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -64,145 +208,1604 @@ func initDB(dbPath string) {
 		calculated_cost REAL NOT NULL DEFAULT 0
 	)`)
 
-	// 添加 supplement 列（如果不存在）
-	db.Exec(`ALTER TABLE expense_usages ADD COLUMN supplement REAL NOT NULL DEFAULT 0`)
-	db.Exec(`ALTER TABLE expense_usages ADD COLUMN discount_usage REAL NOT NULL DEFAULT 0`)
-	db.Exec(`ALTER TABLE expense_usages ADD COLUMN discount_rate REAL NOT NULL DEFAULT 0.5`)
+	// 添加 supplement 列（如果不存在）
+	db.Exec(`ALTER TABLE expense_usages ADD COLUMN supplement REAL NOT NULL DEFAULT 0`)
+	db.Exec(`ALTER TABLE expense_usages ADD COLUMN discount_usage REAL NOT NULL DEFAULT 0`)
+	db.Exec(`ALTER TABLE expense_usages ADD COLUMN discount_rate REAL NOT NULL DEFAULT 0.5`)
+
+	// 费用分摊方式及参数，旧记录按原来固定的 2800 额度、12 个月摊销
+	db.Exec(`ALTER TABLE expense_records ADD COLUMN strategy TEXT NOT NULL DEFAULT 'quota'`)
+	db.Exec(`ALTER TABLE expense_records ADD COLUMN unit_quota REAL NOT NULL DEFAULT 2800`)
+	db.Exec(`ALTER TABLE expense_records ADD COLUMN amortize_months INTEGER NOT NULL DEFAULT 12`)
+	db.Exec(`ALTER TABLE expense_records ADD COLUMN tier_rate REAL NOT NULL DEFAULT 1.5`)
+	// 服务器费用分摊人数（0 表示未记录）和公式版本，用于重新计算历史记录
+	db.Exec(`ALTER TABLE expense_records ADD COLUMN head_count INTEGER NOT NULL DEFAULT 0`)
+	db.Exec(`ALTER TABLE expense_records ADD COLUMN formula_version INTEGER NOT NULL DEFAULT 1`)
+
+	// 金额改为以分为单位的整数；旧的 REAL 列仍同步写入，便于回退到旧版本
+	db.Exec(`ALTER TABLE expense_records ADD COLUMN account_fee_cents INTEGER`)
+	db.Exec(`ALTER TABLE expense_records ADD COLUMN server_fee_cents INTEGER`)
+	db.Exec(`ALTER TABLE expense_usages ADD COLUMN cost_cents INTEGER`)
+	db.Exec(`UPDATE expense_records SET account_fee_cents = CAST(ROUND(account_fee * 100) AS INTEGER) WHERE account_fee_cents IS NULL`)
+	db.Exec(`UPDATE expense_records SET server_fee_cents = CAST(ROUND(server_fee * 100) AS INTEGER) WHERE server_fee_cents IS NULL`)
+	db.Exec(`UPDATE expense_usages SET cost_cents = CAST(ROUND(calculated_cost * 100) AS INTEGER) WHERE cost_cents IS NULL`)
+	// 发票金额（NULL 表示尚未录入）和尾差处理方式
+	db.Exec(`ALTER TABLE expense_records ADD COLUMN invoice_cents INTEGER`)
+	db.Exec(`ALTER TABLE expense_records ADD COLUMN remainder_mode TEXT NOT NULL DEFAULT 'absorb'`)
+	// 按分组计算的记录保存分组，0 表示全部用户
+	db.Exec(`ALTER TABLE expense_records ADD COLUMN group_id INTEGER NOT NULL DEFAULT 0`)
+	// 每人每期的付款登记
+	db.Exec(`ALTER TABLE expense_usages ADD COLUMN paid_cents INTEGER NOT NULL DEFAULT 0`)
+	db.Exec(`ALTER TABLE expense_usages ADD COLUMN paid_date TEXT NOT NULL DEFAULT ''`)
+	db.Exec(`ALTER TABLE expense_usages ADD COLUMN pay_method TEXT NOT NULL DEFAULT ''`)
+	db.Exec(`ALTER TABLE expense_usages ADD COLUMN pay_note TEXT NOT NULL DEFAULT ''`)
+
+	// 组长：可以代其他人修改日程
+	db.Exec(`ALTER TABLE users ADD COLUMN is_lead BOOLEAN NOT NULL DEFAULT 0`)
+
+	// 分组，多对多成员关系
+	db.Exec(`CREATE TABLE IF NOT EXISTS user_groups (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		slug TEXT UNIQUE NOT NULL,
+		name TEXT NOT NULL,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`)
+	db.Exec(`CREATE TABLE IF NOT EXISTS user_group_members (
+		group_id INTEGER NOT NULL REFERENCES user_groups(id),
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		PRIMARY KEY (group_id, user_id)
+	)`)
+
+	// 在岗人数规则，group_id 为 0 表示全部用户
+	db.Exec(`CREATE TABLE IF NOT EXISTS coverage_rules (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		group_id INTEGER NOT NULL DEFAULT 0,
+		weekday INTEGER NOT NULL,
+		min_count INTEGER NOT NULL,
+		enforce INTEGER NOT NULL DEFAULT 0,
+		UNIQUE (group_id, weekday)
+	)`)
+
+	// 首页默认显示的分组，0 表示全部
+	db.Exec(`ALTER TABLE users ADD COLUMN default_group_id INTEGER NOT NULL DEFAULT 0`)
+
+	// 日程最后修改人（代他人修改时与 user_id 不同）
+	db.Exec(`ALTER TABLE schedules ADD COLUMN updated_by INTEGER`)
+
+	// 半天日程：status 为上午，pm_status 为下午，0 表示全天同一状态
+	db.Exec(`ALTER TABLE schedules ADD COLUMN pm_status INTEGER NOT NULL DEFAULT 0`)
+	db.Exec(`ALTER TABLE schedule_changes ADD COLUMN half TEXT NOT NULL DEFAULT ''`)
+
+	// ICS 导入时的关键词映射（每人保存上次使用的配置）
+	db.Exec(`ALTER TABLE users ADD COLUMN ics_mapping TEXT NOT NULL DEFAULT ''`)
+
+	// 日历显示设置：每周第一天、星期标签（逗号分隔，从周日开始，为空用默认）、高亮的星期
+	db.Exec(`ALTER TABLE users ADD COLUMN week_start INTEGER NOT NULL DEFAULT 0`)
+	db.Exec(`ALTER TABLE users ADD COLUMN weekday_labels TEXT NOT NULL DEFAULT ''`)
+	db.Exec(`ALTER TABLE users ADD COLUMN highlight_weekday INTEGER NOT NULL DEFAULT 5`)
+
+	// 个人时区（IANA 名称），为空使用服务器默认时区
+	db.Exec(`ALTER TABLE users ADD COLUMN timezone TEXT NOT NULL DEFAULT ''`)
+
+	// 创建默认 admin 账号
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM users WHERE username = 'admin'").Scan(&count)
+	if count == 0 {
+		hash, _ := bcrypt.GenerateFromPassword([]byte("admin123"), bcrypt.DefaultCost)
+		db.Exec("INSERT INTO users (username, password, display_name, is_admin) VALUES (?, ?, ?, ?)",
+			"admin", string(hash), "管理员", true)
+		log.Println("默认 admin 账号已创建 (admin / admin123)")
+	}
+}
+
+func getUserByUsername(username string) (*User, error) {
+	u := &User{}
+	err := db.QueryRow(
+		"SELECT id, username, password, display_name, is_admin, is_lead, created_at FROM users WHERE username = ?",
+		username,
+	).Scan(&u.ID, &u.Username, &u.Password, &u.DisplayName, &u.IsAdmin, &u.IsLead, &u.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func getAllUsers() ([]User, error) {
+	rows, err := db.Query("SELECT id, username, password, display_name, is_admin, is_lead, created_at FROM users ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var u User
+		rows.Scan(&u.ID, &u.Username, &u.Password, &u.DisplayName, &u.IsAdmin, &u.IsLead, &u.CreatedAt)
+		users = append(users, u)
+	}
+	return users, nil
+}
+
+func createUser(username, password, displayName string, isAdmin, isLead bool) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(
+		"INSERT INTO users (username, password, display_name, is_admin, is_lead) VALUES (?, ?, ?, ?, ?)",
+		username, string(hash), displayName, isAdmin, isLead,
+	)
+	return err
+}
+
+// ========== 分组 ==========
+
+// 获取全部分组及成员
+func getGroups() ([]Group, error) {
+	rows, err := db.Query("SELECT id, slug, name, created_at FROM user_groups ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	var groups []Group
+	index := make(map[int]int)
+	for rows.Next() {
+		g := Group{MemberIDs: make(map[int]bool)}
+		rows.Scan(&g.ID, &g.Slug, &g.Name, &g.CreatedAt)
+		index[g.ID] = len(groups)
+		groups = append(groups, g)
+	}
+	rows.Close()
+
+	rows, err = db.Query("SELECT group_id, user_id FROM user_group_members")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var groupID, userID int
+		rows.Scan(&groupID, &userID)
+		if i, ok := index[groupID]; ok {
+			groups[i].MemberIDs[userID] = true
+		}
+	}
+	return groups, nil
+}
+
+func getGroupBySlug(slug string) (*Group, error) {
+	g := &Group{}
+	err := db.QueryRow("SELECT id, slug, name, created_at FROM user_groups WHERE slug = ?", slug).
+		Scan(&g.ID, &g.Slug, &g.Name, &g.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func getGroupByID(id int) (*Group, error) {
+	g := &Group{}
+	err := db.QueryRow("SELECT id, slug, name, created_at FROM user_groups WHERE id = ?", id).
+		Scan(&g.ID, &g.Slug, &g.Name, &g.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func createGroup(slug, name string) error {
+	_, err := db.Exec("INSERT INTO user_groups (slug, name) VALUES (?, ?)", slug, name)
+	return err
+}
+
+// 删除分组，以它为默认分组的用户恢复显示全部
+func deleteGroup(id int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, q := range []string{
+		"DELETE FROM user_group_members WHERE group_id = ?",
+		"UPDATE users SET default_group_id = 0 WHERE default_group_id = ?",
+		"DELETE FROM coverage_rules WHERE group_id = ?",
+		"DELETE FROM user_groups WHERE id = ?",
+	} {
+		if _, err := tx.Exec(q, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// 替换分组成员
+func setGroupMembers(groupID int, userIDs []int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM user_group_members WHERE group_id = ?", groupID); err != nil {
+		return err
+	}
+	for _, userID := range userIDs {
+		if _, err := tx.Exec("INSERT INTO user_group_members (group_id, user_id) VALUES (?, ?)", groupID, userID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// 获取分组内的用户，groupID 为 0 时返回全部用户
+func getGroupUsers(groupID int) ([]User, error) {
+	users, err := getAllUsers()
+	if err != nil || groupID == 0 {
+		return users, err
+	}
+	rows, err := db.Query("SELECT user_id FROM user_group_members WHERE group_id = ?", groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := make(map[int]bool)
+	for rows.Next() {
+		var id int
+		rows.Scan(&id)
+		members[id] = true
+	}
+	var result []User
+	for _, u := range users {
+		if members[u.ID] {
+			result = append(result, u)
+		}
+	}
+	return result, nil
+}
+
+func getDefaultGroupID(userID int) int {
+	var id int
+	db.QueryRow("SELECT default_group_id FROM users WHERE id = ?", userID).Scan(&id)
+	return id
+}
+
+func setDefaultGroupID(userID, groupID int) error {
+	_, err := db.Exec("UPDATE users SET default_group_id = ? WHERE id = ?", groupID, userID)
+	return err
+}
+
+// ========== 在岗人数规则 ==========
+
+// getCoverageRules 全部在岗人数规则，按分组和星期排序
+func getCoverageRules() ([]CoverageRule, error) {
+	rows, err := db.Query(`
+		SELECT c.id, c.group_id, COALESCE(g.name, ''), c.weekday, c.min_count, c.enforce
+		FROM coverage_rules c
+		LEFT JOIN user_groups g ON c.group_id = g.id
+		ORDER BY c.group_id, c.weekday
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []CoverageRule
+	for rows.Next() {
+		var rule CoverageRule
+		rows.Scan(&rule.ID, &rule.GroupID, &rule.GroupName, &rule.Weekday, &rule.MinCount, &rule.Enforce)
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// setCoverageRule 设置某分组某个星期几的最少在岗人数，已存在时覆盖
+func setCoverageRule(groupID, weekday, minCount int, enforce bool) error {
+	_, err := db.Exec(`
+		INSERT INTO coverage_rules (group_id, weekday, min_count, enforce) VALUES (?, ?, ?, ?)
+		ON CONFLICT(group_id, weekday) DO UPDATE SET min_count = excluded.min_count, enforce = excluded.enforce
+	`, groupID, weekday, minCount, enforce)
+	return err
+}
+
+func deleteCoverageRule(id int) error {
+	_, err := db.Exec("DELETE FROM coverage_rules WHERE id = ?", id)
+	return err
+}
+
+// getSchedules 获取某月的有效日程（month 格式: "2026-02"）
+func getSchedules(userID int, month string) (map[string]DaySchedule, error) {
+	first, err := time.Parse("2006-01", month)
+	if err != nil {
+		return nil, err
+	}
+	return getSchedulesRange(userID, first, first.AddDate(0, 1, -1))
+}
+
+// getSchedulesRange 获取 [start, end] 内的有效日程
+// 显式设置的 schedules 记录优先，其次是节假日日历，最后由周期规则推导，都没有的日期不在结果中
+func getSchedulesRange(userID int, start, end time.Time) (map[string]DaySchedule, error) {
+	rows, err := db.Query(`
+		SELECT s.date, s.status, s.pm_status, COALESCE(u.display_name, '')
+		FROM schedules s
+		LEFT JOIN users u ON s.updated_by = u.id AND s.updated_by != s.user_id
+		WHERE s.user_id = ? AND s.date BETWEEN ? AND ?
+	`, userID, start.Format("2006-01-02"), end.Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[string]DaySchedule)
+	for rows.Next() {
+		var date, editedBy string
+		var status, pmStatus int
+		rows.Scan(&date, &status, &pmStatus, &editedBy)
+		result[date] = DaySchedule{Status: status, PMStatus: pmStatus, Source: SourceExplicit, EditedBy: editedBy}
+	}
+
+	holidays, err := getHolidays(start, end)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := getScheduleRules(userID)
+	if err != nil {
+		return nil, err
+	}
+	for d := start; !d.After(end); d = d.AddDate(0, 0, 1) {
+		date := d.Format("2006-01-02")
+		if _, ok := result[date]; ok {
+			continue
+		}
+		if h, ok := holidays[date]; ok {
+			result[date] = DaySchedule{Status: h.DefaultStatus(), Source: SourceHoliday}
+			continue
+		}
+		for _, rule := range rules {
+			if rule.Matches(d) {
+				result[date] = DaySchedule{Status: rule.Status, Source: SourceRule}
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
+// setSchedule 设置某天的状态，actorID 为操作人
+func setSchedule(userID int, date string, status int, actorID int) error {
+	return setSchedules(userID, map[string]int{date: status}, actorID)
+}
+
+// 批量设置日程，所有日期在同一事务中写入，每次写入都记录变更
+func setSchedules(userID int, entries map[string]int, actorID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := writeSchedules(tx, userID, entries, actorID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// writeSchedules 在已有事务中写入日程并记录变更，状态为 StatusUnset 时删除显式设置。
+// 原来上下午不同时分别记录两个半天的变更，保留各自的原状态
+func writeSchedules(tx *sql.Tx, userID int, entries map[string]int, actorID int) error {
+	for date, status := range entries {
+		var old, oldPM sql.NullInt64
+		err := tx.QueryRow("SELECT status, pm_status FROM schedules WHERE user_id = ? AND date = ?", userID, date).Scan(&old, &oldPM)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+
+		if status == StatusUnset {
+			if !old.Valid {
+				continue
+			}
+			_, err = tx.Exec("DELETE FROM schedules WHERE user_id = ? AND date = ?", userID, date)
+		} else {
+			_, err = tx.Exec(
+				`INSERT INTO schedules (user_id, date, status, pm_status, updated_by) VALUES (?, ?, ?, 0, ?)
+				 ON CONFLICT(user_id, date) DO UPDATE SET status = excluded.status, pm_status = 0, updated_by = excluded.updated_by`,
+				userID, date, status, actorID,
+			)
+		}
+		if err != nil {
+			return err
+		}
+
+		prev := DaySchedule{Status: int(old.Int64), PMStatus: int(oldPM.Int64)}
+		if old.Valid && prev.Split() {
+			for _, h := range []struct {
+				half string
+				old  int
+			}{{HalfAM, prev.Status}, {HalfPM, prev.PMStatus}} {
+				_, err = tx.Exec(
+					`INSERT INTO schedule_changes (user_id, date, old_status, new_status, actor_id, half) VALUES (?, ?, ?, ?, ?, ?)`,
+					userID, date, h.old, status, actorID, h.half,
+				)
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		_, err = tx.Exec(
+			`INSERT INTO schedule_changes (user_id, date, old_status, new_status, actor_id) VALUES (?, ?, ?, ?, ?)`,
+			userID, date, old, status, actorID,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setScheduleHalf 只设置某天的上午或下午，另一半保持原来的有效状态（含周期规则 / 节假日）
+// 返回写入后的上午、下午状态，上下午相同时合并为全天
+func setScheduleHalf(userID int, date, half string, status, actorID int) (am, pm int, err error) {
+	// 没有显式设置时按节假日、周期规则得出的状态，只在事务外计算
+	current := getDaySchedule(userID, date)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	// 显式设置在事务内读取，避免覆盖同时修改的另一半天
+	var rowAM, rowPM int
+	err = tx.QueryRow("SELECT status, pm_status FROM schedules WHERE user_id = ? AND date = ?", userID, date).Scan(&rowAM, &rowPM)
+	explicit := err == nil
+	if err != nil && err != sql.ErrNoRows {
+		return 0, 0, err
+	}
+	if explicit {
+		current = DaySchedule{Status: rowAM, PMStatus: rowPM, Source: SourceExplicit}
+	} else if current.Source == SourceExplicit {
+		// 显式设置在读取后被删除
+		current = DaySchedule{Status: StatusDefault}
+	}
+
+	am, pm = current.Halves()
+	old := am
+	if half == HalfPM {
+		old = pm
+		pm = status
+	} else {
+		am = status
+	}
+	pmStatus := pm
+	if am == pm {
+		pmStatus = 0
+	}
+
+	var oldStatus sql.NullInt64
+	if explicit {
+		oldStatus = sql.NullInt64{Int64: int64(old), Valid: true}
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO schedules (user_id, date, status, pm_status, updated_by) VALUES (?, ?, ?, ?, ?)
+		 ON CONFLICT(user_id, date) DO UPDATE SET status = excluded.status, pm_status = excluded.pm_status, updated_by = excluded.updated_by`,
+		userID, date, am, pmStatus, actorID,
+	)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO schedule_changes (user_id, date, old_status, new_status, actor_id, half) VALUES (?, ?, ?, ?, ?, ?)`,
+		userID, date, oldStatus, status, actorID, half,
+	)
+	if err != nil {
+		return 0, 0, err
+	}
+	return am, pm, tx.Commit()
+}
+
+// 获取用户的日程变更记录，month 为空时返回最近的记录
+func getScheduleChanges(userID int, month string, limit int) ([]ScheduleChange, error) {
+	rows, err := db.Query(`
+		SELECT c.id, c.user_id, c.date, COALESCE(c.old_status, 0), c.new_status, c.half, c.actor_id,
+		       COALESCE(u.display_name, '已删除用户'), c.created_at
+		FROM schedule_changes c
+		LEFT JOIN users u ON c.actor_id = u.id
+		WHERE c.user_id = ? AND c.date LIKE ?
+		ORDER BY c.id DESC LIMIT ?
+	`, userID, month+"%", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []ScheduleChange
+	for rows.Next() {
+		var c ScheduleChange
+		rows.Scan(&c.ID, &c.UserID, &c.Date, &c.OldStatus, &c.NewStatus, &c.Half, &c.ActorID, &c.ActorName, &c.CreatedAt)
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
+
+// getInheritedSchedule 不考虑显式设置时某天的日程，即清除显式设置后回落到的节假日 / 周期规则状态
+func getInheritedSchedule(userID int, date string) (DaySchedule, error) {
+	d, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return DaySchedule{}, err
+	}
+	holidays, err := getHolidays(d, d)
+	if err != nil {
+		return DaySchedule{}, err
+	}
+	if h, ok := holidays[date]; ok {
+		return DaySchedule{Status: h.DefaultStatus(), Source: SourceHoliday}, nil
+	}
+	rules, err := getScheduleRules(userID)
+	if err != nil {
+		return DaySchedule{}, err
+	}
+	for _, rule := range rules {
+		if rule.Matches(d) {
+			return DaySchedule{Status: rule.Status, Source: SourceRule}, nil
+		}
+	}
+	return DaySchedule{Status: StatusDefault}, nil
+}
+
+// getScheduleStatus 获取某天的有效状态（含周期规则），分上下午时为上午的状态
+func getScheduleStatus(userID int, date string) int {
+	return getDaySchedule(userID, date).Status
+}
+
+// getDaySchedule 获取某天的有效日程，没有任何设置时为全天默认
+func getDaySchedule(userID int, date string) DaySchedule {
+	d, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return DaySchedule{Status: StatusDefault}
+	}
+	schedules, err := getSchedulesRange(userID, d, d)
+	if err != nil {
+		return DaySchedule{Status: StatusDefault}
+	}
+	if s, ok := schedules[date]; ok {
+		return s
+	}
+	return DaySchedule{Status: StatusDefault}
+}
+
+// 获取用户所有显式设置的非默认日程（日历订阅导出）
+func getMarkedSchedules(userID int) ([]Schedule, error) {
+	rows, err := db.Query(
+		"SELECT id, user_id, date, status, pm_status FROM schedules WHERE user_id = ? AND (status != ? OR pm_status NOT IN (0, ?)) ORDER BY date",
+		userID, StatusDefault, StatusDefault,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var schedules []Schedule
+	for rows.Next() {
+		var s Schedule
+		rows.Scan(&s.ID, &s.UserID, &s.Date, &s.Status, &s.PMStatus)
+		schedules = append(schedules, s)
+	}
+	return schedules, nil
+}
+
+// ========== 备注与评论 ==========
+
+// 获取 [start, end] 内的备注
+func getScheduleNotes(userID int, start, end time.Time) (map[string]string, error) {
+	rows, err := db.Query("SELECT date, note FROM schedule_notes WHERE user_id = ? AND date BETWEEN ? AND ?",
+		userID, start.Format("2006-01-02"), end.Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notes := make(map[string]string)
+	for rows.Next() {
+		var date, note string
+		rows.Scan(&date, &note)
+		notes[date] = note
+	}
+	return notes, nil
+}
+
+func getScheduleNote(userID int, date string) string {
+	var note string
+	db.QueryRow("SELECT note FROM schedule_notes WHERE user_id = ? AND date = ?", userID, date).Scan(&note)
+	return note
+}
+
+// 设置备注，空字符串表示删除
+func setScheduleNote(userID int, date, note string) error {
+	if note == "" {
+		_, err := db.Exec("DELETE FROM schedule_notes WHERE user_id = ? AND date = ?", userID, date)
+		return err
+	}
+	_, err := db.Exec(
+		`INSERT INTO schedule_notes (user_id, date, note) VALUES (?, ?, ?)
+		 ON CONFLICT(user_id, date) DO UPDATE SET note = excluded.note, updated_at = CURRENT_TIMESTAMP`,
+		userID, date, note,
+	)
+	return err
+}
+
+// 获取 [start, end] 内每天的评论数
+func getCommentCounts(userID int, start, end time.Time) (map[string]int, error) {
+	rows, err := db.Query(`SELECT date, COUNT(*) FROM schedule_comments
+		WHERE user_id = ? AND date BETWEEN ? AND ? GROUP BY date`,
+		userID, start.Format("2006-01-02"), end.Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var date string
+		var n int
+		rows.Scan(&date, &n)
+		counts[date] = n
+	}
+	return counts, nil
+}
+
+// getScheduleComments 获取某天的评论，按回复关系组织成树，返回顶层评论
+func getScheduleComments(userID int, date string) ([]*ScheduleComment, error) {
+	rows, err := db.Query(`
+		SELECT c.id, c.user_id, c.date, c.author_id, COALESCE(u.display_name, '已删除用户'), c.parent_id, c.body, c.created_at
+		FROM schedule_comments c
+		LEFT JOIN users u ON c.author_id = u.id
+		WHERE c.user_id = ? AND c.date = ?
+		ORDER BY c.id
+	`, userID, date)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byID := make(map[int]*ScheduleComment)
+	var all []*ScheduleComment
+	for rows.Next() {
+		c := &ScheduleComment{}
+		rows.Scan(&c.ID, &c.UserID, &c.Date, &c.AuthorID, &c.AuthorName, &c.ParentID, &c.Body, &c.CreatedAt)
+		byID[c.ID] = c
+		all = append(all, c)
+	}
+
+	var roots []*ScheduleComment
+	for _, c := range all {
+		if parent, ok := byID[c.ParentID]; ok {
+			parent.Replies = append(parent.Replies, c)
+		} else {
+			roots = append(roots, c)
+		}
+	}
+	return roots, nil
+}
+
+func getScheduleCommentByID(id int) (*ScheduleComment, error) {
+	c := &ScheduleComment{}
+	err := db.QueryRow("SELECT id, user_id, date, author_id, parent_id, body, created_at FROM schedule_comments WHERE id = ?", id).
+		Scan(&c.ID, &c.UserID, &c.Date, &c.AuthorID, &c.ParentID, &c.Body, &c.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func createScheduleComment(userID int, date string, authorID, parentID int, body string) error {
+	_, err := db.Exec(
+		"INSERT INTO schedule_comments (user_id, date, author_id, parent_id, body) VALUES (?, ?, ?, ?, ?)",
+		userID, date, authorID, parentID, body,
+	)
+	return err
+}
+
+// 删除评论，回复挂到被删评论的上一级
+func deleteScheduleComment(id int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var parentID int
+	if err := tx.QueryRow("SELECT parent_id FROM schedule_comments WHERE id = ?", id).Scan(&parentID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE schedule_comments SET parent_id = ? WHERE parent_id = ?", parentID, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM schedule_comments WHERE id = ?", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ========== 节假日 ==========
+
+// 获取 [start, end] 内的节假日，按日期索引
+func getHolidays(start, end time.Time) (map[string]Holiday, error) {
+	rows, err := db.Query(
+		"SELECT date, name, kind FROM holidays WHERE date BETWEEN ? AND ?",
+		start.Format("2006-01-02"), end.Format("2006-01-02"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[string]Holiday)
+	for rows.Next() {
+		var h Holiday
+		rows.Scan(&h.Date, &h.Name, &h.Kind)
+		result[h.Date] = h
+	}
+	return result, nil
+}
+
+// 获取某日期之后的所有节假日（后台列表）
+func getHolidaysFrom(date string) ([]Holiday, error) {
+	rows, err := db.Query("SELECT date, name, kind FROM holidays WHERE date >= ? ORDER BY date", date)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var holidays []Holiday
+	for rows.Next() {
+		var h Holiday
+		rows.Scan(&h.Date, &h.Name, &h.Kind)
+		holidays = append(holidays, h)
+	}
+	return holidays, nil
+}
+
+// 批量导入节假日，同一日期覆盖旧数据
+func saveHolidays(holidays []Holiday) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, h := range holidays {
+		_, err := tx.Exec(
+			`INSERT INTO holidays (date, name, kind) VALUES (?, ?, ?)
+			 ON CONFLICT(date) DO UPDATE SET name = excluded.name, kind = excluded.kind`,
+			h.Date, h.Name, h.Kind,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func deleteHoliday(date string) error {
+	_, err := db.Exec("DELETE FROM holidays WHERE date = ?", date)
+	return err
+}
+
+// ========== 周期规则 ==========
+
+// 获取用户的周期规则，后创建的优先
+func getScheduleRules(userID int) ([]ScheduleRule, error) {
+	rows, err := db.Query(`SELECT id, user_id, status, weekdays, interval_weeks, start_date, end_date, created_at
+		FROM schedule_rules WHERE user_id = ? ORDER BY id DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []ScheduleRule
+	for rows.Next() {
+		var r ScheduleRule
+		rows.Scan(&r.ID, &r.UserID, &r.Status, &r.Weekdays, &r.IntervalWeeks, &r.StartDate, &r.EndDate, &r.CreatedAt)
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func createScheduleRule(r ScheduleRule) error {
+	_, err := db.Exec(
+		`INSERT INTO schedule_rules (user_id, status, weekdays, interval_weeks, start_date, end_date) VALUES (?, ?, ?, ?, ?, ?)`,
+		r.UserID, r.Status, r.Weekdays, r.IntervalWeeks, r.StartDate, r.EndDate,
+	)
+	return err
+}
+
+// 删除规则，限定 userID 防止删除他人的规则
+func deleteScheduleRule(id, userID int) error {
+	_, err := db.Exec("DELETE FROM schedule_rules WHERE id = ? AND user_id = ?", id, userID)
+	return err
+}
+
+// ========== 请假申请 ==========
+
+const leaveRequestColumns = `l.id, l.user_id, COALESCE(u.display_name, ''), l.start_date, l.end_date, l.reason, l.status,
+	COALESCE(l.approver_id, 0), COALESCE(a.display_name, ''), l.comment, l.created_at, l.decided_at`
+
+const leaveRequestFrom = `FROM leave_requests l
+	LEFT JOIN users u ON l.user_id = u.id
+	LEFT JOIN users a ON l.approver_id = a.id`
+
+func scanLeaveRequests(rows *sql.Rows) []LeaveRequest {
+	var list []LeaveRequest
+	for rows.Next() {
+		var l LeaveRequest
+		rows.Scan(&l.ID, &l.UserID, &l.UserName, &l.StartDate, &l.EndDate, &l.Reason, &l.Status,
+			&l.ApproverID, &l.ApproverName, &l.Comment, &l.CreatedAt, &l.DecidedAt)
+		list = append(list, l)
+	}
+	return list
+}
+
+func createLeaveRequest(userID int, startDate, endDate, reason string) error {
+	_, err := db.Exec(
+		"INSERT INTO leave_requests (user_id, start_date, end_date, reason) VALUES (?, ?, ?, ?)",
+		userID, startDate, endDate, reason,
+	)
+	return err
+}
+
+// 获取用户的请假申请，最新的在前
+func getUserLeaveRequests(userID int) ([]LeaveRequest, error) {
+	rows, err := db.Query("SELECT "+leaveRequestColumns+" "+leaveRequestFrom+
+		" WHERE l.user_id = ? ORDER BY l.id DESC", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanLeaveRequests(rows), nil
+}
+
+// 获取待审批的申请，按提交顺序
+func getPendingLeaveRequests() ([]LeaveRequest, error) {
+	rows, err := db.Query("SELECT "+leaveRequestColumns+" "+leaveRequestFrom+
+		" WHERE l.status = ? ORDER BY l.id", LeavePending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanLeaveRequests(rows), nil
+}
+
+// 获取已审批的申请（批准或驳回），最近的在前
+func getDecidedLeaveRequests(limit int) ([]LeaveRequest, error) {
+	rows, err := db.Query("SELECT "+leaveRequestColumns+" "+leaveRequestFrom+
+		" WHERE l.status IN (?, ?) ORDER BY l.decided_at DESC, l.id DESC LIMIT ?",
+		LeaveApproved, LeaveRejected, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanLeaveRequests(rows), nil
+}
+
+func getLeaveRequestByID(id int) (*LeaveRequest, error) {
+	rows, err := db.Query("SELECT "+leaveRequestColumns+" "+leaveRequestFrom+" WHERE l.id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := scanLeaveRequests(rows)
+	if len(list) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &list[0], nil
+}
+
+// 检查用户是否已有与日期范围重叠的待审批或已批准申请
+func hasOverlappingLeave(userID int, startDate, endDate string) bool {
+	var count int
+	db.QueryRow(`SELECT COUNT(*) FROM leave_requests
+		WHERE user_id = ? AND status IN (?, ?) AND start_date <= ? AND end_date >= ?`,
+		userID, LeavePending, LeaveApproved, endDate, startDate,
+	).Scan(&count)
+	return count > 0
+}
+
+// 获取用户在日期范围内待审批的日期
+func getPendingLeaveDates(userID int, start, end time.Time) (map[string]bool, error) {
+	startStr, endStr := start.Format("2006-01-02"), end.Format("2006-01-02")
+	rows, err := db.Query(`SELECT start_date, end_date FROM leave_requests
+		WHERE user_id = ? AND status = ? AND start_date <= ? AND end_date >= ?`,
+		userID, LeavePending, endStr, startStr)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	dates := make(map[string]bool)
+	for rows.Next() {
+		var from, to string
+		rows.Scan(&from, &to)
+		for d := from; d <= to; {
+			if d >= startStr && d <= endStr {
+				dates[d] = true
+			}
+			t, err := time.Parse("2006-01-02", d)
+			if err != nil {
+				break
+			}
+			d = t.AddDate(0, 0, 1).Format("2006-01-02")
+		}
+	}
+	return dates, nil
+}
+
+// 待审批申请数量
+func countPendingLeaveRequests() int {
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM leave_requests WHERE status = ?", LeavePending).Scan(&count)
+	return count
+}
+
+// 撤回申请，只能撤回自己待审批的申请
+func cancelLeaveRequest(id, userID int) error {
+	_, err := db.Exec("UPDATE leave_requests SET status = ? WHERE id = ? AND user_id = ? AND status = ?",
+		LeaveCancelled, id, userID, LeavePending)
+	return err
+}
+
+// decideLeaveRequest 审批申请；批准时在同一事务中把日期范围写为休息，操作人记为审批人
+func decideLeaveRequest(id int, approve bool, approverID int, comment string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	var startDate, endDate string
+	err = tx.QueryRow("SELECT user_id, start_date, end_date FROM leave_requests WHERE id = ? AND status = ?",
+		id, LeavePending).Scan(&userID, &startDate, &endDate)
+	if err != nil {
+		return err
+	}
+
+	status := LeaveRejected
+	if approve {
+		status = LeaveApproved
+	}
+	_, err = tx.Exec(`UPDATE leave_requests SET status = ?, approver_id = ?, comment = ?, decided_at = CURRENT_TIMESTAMP
+		WHERE id = ?`, status, approverID, comment, id)
+	if err != nil {
+		return err
+	}
+
+	if approve {
+		start, end, err := parseDateRange(startDate, endDate)
+		if err != nil {
+			return err
+		}
+		entries := make(map[string]int)
+		for d := start; !d.After(end); d = d.AddDate(0, 0, 1) {
+			entries[d.Format("2006-01-02")] = StatusRest
+		}
+		if err := writeSchedules(tx, userID, entries, approverID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ========== 值班轮换 ==========
+
+// createRotation 创建轮换及其成员
+func createRotation(rt Rotation) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("INSERT INTO rotations (name, shift_days, start_date, skip_holidays) VALUES (?, ?, ?, ?)",
+		rt.Name, rt.ShiftDays, rt.StartDate, rt.SkipHolidays)
+	if err != nil {
+		return err
+	}
+	id, _ := res.LastInsertId()
+	for _, m := range rt.Members {
+		if _, err := tx.Exec("INSERT INTO rotation_members (rotation_id, user_id, position) VALUES (?, ?, ?)",
+			id, m.UserID, m.Position); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// 获取全部轮换及成员
+func getRotations() ([]Rotation, error) {
+	rows, err := db.Query("SELECT id, name, shift_days, start_date, skip_holidays, created_at FROM rotations ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	var rotations []Rotation
+	for rows.Next() {
+		var rt Rotation
+		rows.Scan(&rt.ID, &rt.Name, &rt.ShiftDays, &rt.StartDate, &rt.SkipHolidays, &rt.CreatedAt)
+		rotations = append(rotations, rt)
+	}
+	rows.Close()
+
+	for i := range rotations {
+		rotations[i].Members, err = getRotationMembers(rotations[i].ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rotations, nil
+}
+
+func getRotationByID(id int) (*Rotation, error) {
+	rt := &Rotation{}
+	err := db.QueryRow("SELECT id, name, shift_days, start_date, skip_holidays, created_at FROM rotations WHERE id = ?", id).
+		Scan(&rt.ID, &rt.Name, &rt.ShiftDays, &rt.StartDate, &rt.SkipHolidays, &rt.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	rt.Members, err = getRotationMembers(id)
+	return rt, err
+}
+
+func getRotationMembers(rotationID int) ([]RotationMember, error) {
+	rows, err := db.Query(`SELECT m.user_id, u.display_name, m.position
+		FROM rotation_members m JOIN users u ON m.user_id = u.id
+		WHERE m.rotation_id = ? ORDER BY m.position, m.user_id`, rotationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []RotationMember
+	for rows.Next() {
+		var m RotationMember
+		rows.Scan(&m.UserID, &m.DisplayName, &m.Position)
+		members = append(members, m)
+	}
+	return members, nil
+}
+
+// 删除轮换，已写入的日程保留
+func deleteRotation(id int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, q := range []string{
+		"DELETE FROM rotation_swaps WHERE rotation_id = ?",
+		"DELETE FROM rotation_shifts WHERE rotation_id = ?",
+		"DELETE FROM rotation_members WHERE rotation_id = ?",
+		"DELETE FROM rotations WHERE id = ?",
+	} {
+		if _, err := tx.Exec(q, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// saveRotationShifts 用新的排班替换 from 之后的安排，并写入日程
+//
+// 不再值班的成员如果当天仍是 🐮🐴 则清除显式设置，回落到节假日 / 周期规则；新值班的成员当天已单独设置为休息等不上班状态
+// （如请假）时不覆盖，计入 conflicts 由成员自行换班；节假日和周期规则推导的休息会被覆盖
+func saveRotationShifts(rotationID int, from time.Time, assign map[string]int, actorID int) (written, conflicts int, err error) {
+	fromStr := from.Format("2006-01-02")
+	to := from
+	for date := range assign {
+		if d, _ := time.Parse("2006-01-02", date); d.After(to) {
+			to = d
+		}
+	}
+
+	rows, err := db.Query("SELECT date, user_id FROM rotation_shifts WHERE rotation_id = ? AND date >= ?", rotationID, fromStr)
+	if err != nil {
+		return 0, 0, err
+	}
+	old := make(map[string]int)
+	for rows.Next() {
+		var date string
+		var userID int
+		rows.Scan(&date, &userID)
+		old[date] = userID
+	}
+	rows.Close()
+
+	// 涉及成员的有效日程（含周期规则 / 节假日），用于判断是否覆盖
+	effective := make(map[int]map[string]DaySchedule)
+	for _, userID := range append(mapValues(old), mapValues(assign)...) {
+		if _, ok := effective[userID]; ok {
+			continue
+		}
+		if effective[userID], err = getSchedulesRange(userID, from, to); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	writes := make(map[int]map[string]int)
+	put := func(userID int, date string, status int) {
+		if writes[userID] == nil {
+			writes[userID] = make(map[string]int)
+		}
+		writes[userID][date] = status
+	}
+	for date, userID := range old {
+		if assign[date] != userID && effective[userID][date].Status == StatusFire && !effective[userID][date].Split() {
+			put(userID, date, StatusUnset)
+		}
+	}
+	for date, userID := range assign {
+		cur := effective[userID][date]
+		am, pm := cur.Halves()
+		if cur.Source == SourceExplicit && (isOffStatus(am) || isOffStatus(pm)) {
+			conflicts++
+			continue
+		}
+		if am != StatusFire || pm != StatusFire {
+			put(userID, date, StatusFire)
+			written++
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM rotation_shifts WHERE rotation_id = ? AND date >= ?", rotationID, fromStr); err != nil {
+		return 0, 0, err
+	}
+	for date, userID := range assign {
+		if _, err := tx.Exec("INSERT INTO rotation_shifts (rotation_id, user_id, date) VALUES (?, ?, ?)",
+			rotationID, userID, date); err != nil {
+			return 0, 0, err
+		}
+	}
+	for userID, entries := range writes {
+		if err := writeSchedules(tx, userID, entries, actorID); err != nil {
+			return 0, 0, err
+		}
+	}
+	return written, conflicts, tx.Commit()
+}
 
-	// 创建默认 admin 账号
-	var count int
-	db.QueryRow("SELECT COUNT(*) FROM users WHERE username = 'admin'").Scan(&count)
-	if count == 0 {
-		hash, _ := bcrypt.GenerateFromPassword([]byte("admin123"), bcrypt.DefaultCost)
-		db.Exec("INSERT INTO users (username, password, display_name, is_admin) VALUES (?, ?, ?, ?)",
-			"admin", string(hash), "管理员", true)
-		log.Println("默认 admin 账号已创建 (admin / admin123)")
+func mapValues(m map[string]int) []int {
+	var values []int
+	for _, v := range m {
+		values = append(values, v)
 	}
+	return values
 }
 
-func getUserByUsername(username string) (*User, error) {
-	u := &User{}
-	err := db.QueryRow(
-		"SELECT id, username, password, display_name, is_admin, created_at FROM users WHERE username = ?",
-		username,
-	).Scan(&u.ID, &u.Username, &u.Password, &u.DisplayName, &u.IsAdmin, &u.CreatedAt)
+// 获取 [start, end] 内所有轮换的值班安排，按日期排序
+func getRotationShifts(start, end time.Time) ([]RotationShift, error) {
+	rows, err := db.Query(`
+		SELECT s.id, s.rotation_id, r.name, s.user_id, COALESCE(u.display_name, '已删除用户'), s.date
+		FROM rotation_shifts s
+		JOIN rotations r ON s.rotation_id = r.id
+		LEFT JOIN users u ON s.user_id = u.id
+		WHERE s.date BETWEEN ? AND ?
+		ORDER BY s.date, r.id
+	`, start.Format("2006-01-02"), end.Format("2006-01-02"))
 	if err != nil {
 		return nil, err
 	}
-	return u, nil
+	defer rows.Close()
+
+	var shifts []RotationShift
+	for rows.Next() {
+		var s RotationShift
+		rows.Scan(&s.ID, &s.RotationID, &s.RotationName, &s.UserID, &s.UserName, &s.Date)
+		shifts = append(shifts, s)
+	}
+	return shifts, nil
 }
 
-func getAllUsers() ([]User, error) {
-	rows, err := db.Query("SELECT id, username, password, display_name, is_admin, created_at FROM users ORDER BY id")
+// 获取某轮换某天的值班人
+func getRotationShiftUser(rotationID int, date string) (int, error) {
+	var userID int
+	err := db.QueryRow("SELECT user_id FROM rotation_shifts WHERE rotation_id = ? AND date = ?", rotationID, date).Scan(&userID)
+	return userID, err
+}
+
+func createRotationSwap(sw RotationSwap) error {
+	_, err := db.Exec(
+		`INSERT INTO rotation_swaps (rotation_id, requester_id, requester_date, target_id, target_date) VALUES (?, ?, ?, ?, ?)`,
+		sw.RotationID, sw.RequesterID, sw.RequesterDate, sw.TargetID, sw.TargetDate,
+	)
+	return err
+}
+
+// 获取与用户相关（发起或收到）的换班申请，最新的在前
+func getUserRotationSwaps(userID int) ([]RotationSwap, error) {
+	rows, err := db.Query(`
+		SELECT w.id, w.rotation_id, r.name, w.requester_id, COALESCE(a.display_name, ''), w.requester_date,
+		       w.target_id, COALESCE(b.display_name, ''), w.target_date, w.status, w.created_at
+		FROM rotation_swaps w
+		JOIN rotations r ON w.rotation_id = r.id
+		LEFT JOIN users a ON w.requester_id = a.id
+		LEFT JOIN users b ON w.target_id = b.id
+		WHERE w.requester_id = ? OR w.target_id = ?
+		ORDER BY w.id DESC LIMIT 100
+	`, userID, userID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var users []User
+	var swaps []RotationSwap
 	for rows.Next() {
-		var u User
-		rows.Scan(&u.ID, &u.Username, &u.Password, &u.DisplayName, &u.IsAdmin, &u.CreatedAt)
-		users = append(users, u)
+		var sw RotationSwap
+		rows.Scan(&sw.ID, &sw.RotationID, &sw.RotationName, &sw.RequesterID, &sw.RequesterName, &sw.RequesterDate,
+			&sw.TargetID, &sw.TargetName, &sw.TargetDate, &sw.Status, &sw.CreatedAt)
+		swaps = append(swaps, sw)
 	}
-	return users, nil
+	return swaps, nil
 }
 
-func createUser(username, password, displayName string, isAdmin bool) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+// 撤回换班申请，只能撤回自己发起的待确认申请
+func cancelRotationSwap(id, requesterID int) error {
+	_, err := db.Exec("UPDATE rotation_swaps SET status = ?, decided_at = CURRENT_TIMESTAMP WHERE id = ? AND requester_id = ? AND status = ?",
+		SwapCancelled, id, requesterID, SwapPending)
+	return err
+}
+
+// 获取收到的待确认换班申请
+func getPendingRotationSwap(id, targetID int) (*RotationSwap, error) {
+	sw := &RotationSwap{ID: id, Status: SwapPending}
+	err := db.QueryRow(`SELECT rotation_id, requester_id, requester_date, target_id, target_date
+		FROM rotation_swaps WHERE id = ? AND target_id = ? AND status = ?`, id, targetID, SwapPending).
+		Scan(&sw.RotationID, &sw.RequesterID, &sw.RequesterDate, &sw.TargetID, &sw.TargetDate)
+	if err != nil {
+		return nil, err
+	}
+	return sw, nil
+}
+
+// 用户某天是否有已批准的请假
+func hasApprovedLeave(userID int, date string) bool {
+	var count int
+	db.QueryRow(`SELECT COUNT(*) FROM leave_requests
+		WHERE user_id = ? AND status = ? AND start_date <= ? AND end_date >= ?`,
+		userID, LeaveApproved, date, date,
+	).Scan(&count)
+	return count > 0
+}
+
+// decideRotationSwap 对方接受或拒绝换班；接受时交换两天的值班人并更新双方日程
+func decideRotationSwap(id, targetID int, accept bool) error {
+	tx, err := db.Begin()
 	if err != nil {
 		return err
 	}
-	_, err = db.Exec(
-		"INSERT INTO users (username, password, display_name, is_admin) VALUES (?, ?, ?, ?)",
-		username, string(hash), displayName, isAdmin,
+	defer tx.Rollback()
+
+	var sw RotationSwap
+	err = tx.QueryRow(`SELECT rotation_id, requester_id, requester_date, target_id, target_date
+		FROM rotation_swaps WHERE id = ? AND target_id = ? AND status = ?`, id, targetID, SwapPending).
+		Scan(&sw.RotationID, &sw.RequesterID, &sw.RequesterDate, &sw.TargetID, &sw.TargetDate)
+	if err != nil {
+		return fmt.Errorf("换班申请不存在或已处理")
+	}
+
+	status := SwapRejected
+	if accept {
+		status = SwapAccepted
+		// 申请之后排班可能已重新生成，确认双方仍在原来的班次
+		var a, b int
+		tx.QueryRow("SELECT user_id FROM rotation_shifts WHERE rotation_id = ? AND date = ?", sw.RotationID, sw.RequesterDate).Scan(&a)
+		tx.QueryRow("SELECT user_id FROM rotation_shifts WHERE rotation_id = ? AND date = ?", sw.RotationID, sw.TargetDate).Scan(&b)
+		if a != sw.RequesterID || b != sw.TargetID {
+			return fmt.Errorf("排班已变化，换班申请失效")
+		}
+
+		for _, q := range []struct {
+			userID int
+			date   string
+		}{{sw.TargetID, sw.RequesterDate}, {sw.RequesterID, sw.TargetDate}} {
+			if _, err := tx.Exec("UPDATE rotation_shifts SET user_id = ? WHERE rotation_id = ? AND date = ?",
+				q.userID, sw.RotationID, q.date); err != nil {
+				return err
+			}
+		}
+		for userID, changes := range sw.ScheduleChanges() {
+			if err := writeSchedules(tx, userID, changes, targetID); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err := tx.Exec("UPDATE rotation_swaps SET status = ?, decided_at = CURRENT_TIMESTAMP WHERE id = ?", status, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ========== 年假额度 ==========
+
+// 设置年假额度，quota < 0 表示取消额度
+func setLeaveQuota(userID, year int, quota float64) error {
+	if quota < 0 {
+		_, err := db.Exec("DELETE FROM leave_quotas WHERE user_id = ? AND year = ?", userID, year)
+		return err
+	}
+	_, err := db.Exec(
+		`INSERT INTO leave_quotas (user_id, year, quota) VALUES (?, ?, ?)
+		 ON CONFLICT(user_id, year) DO UPDATE SET quota = excluded.quota`,
+		userID, year, quota,
 	)
 	return err
 }
 
-func getSchedules(userID int, month string) (map[string]int, error) {
-	// month 格式: "2026-02"
-	rows, err := db.Query(
-		"SELECT date, status FROM schedules WHERE user_id = ? AND date LIKE ?",
-		userID, month+"%",
-	)
+// getLeaveBalance 计算某人某年的年假使用情况，已用天数为显式设置为休息的日期，半天计 0.5
+func getLeaveBalance(userID, year int) LeaveBalance {
+	b := LeaveBalance{Year: year}
+	err := db.QueryRow("SELECT quota FROM leave_quotas WHERE user_id = ? AND year = ?", userID, year).Scan(&b.Quota)
+	b.HasQuota = err == nil
+
+	// 分上下午的日期按半天计
+	db.QueryRow(`SELECT COALESCE(SUM(CASE
+			WHEN pm_status = 0 THEN (status = ?) * 1.0
+			ELSE (status = ?) * 0.5 + (pm_status = ?) * 0.5 END), 0)
+		FROM schedules WHERE user_id = ? AND date LIKE ?`,
+		StatusRest, StatusRest, StatusRest, userID, fmt.Sprintf("%04d-%%", year)).Scan(&b.Used)
+
+	start := time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC)
+	pending, _ := getPendingLeaveDates(userID, start, start.AddDate(1, 0, -1))
+	b.Pending = float64(len(pending))
+
+	// 已经显式设为休息的半天已计入 Used，不再重复计入待审批
+	rows, err := db.Query(`SELECT date, status, pm_status FROM schedules WHERE user_id = ? AND date LIKE ?`,
+		userID, fmt.Sprintf("%04d-%%", year))
+	if err != nil {
+		return b
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var date string
+		var am, pm int
+		rows.Scan(&date, &am, &pm)
+		if !pending[date] {
+			continue
+		}
+		if pm == 0 {
+			pm = am
+		}
+		for _, status := range []int{am, pm} {
+			if status == StatusRest {
+				b.Pending -= 0.5
+			}
+		}
+	}
+	return b
+}
+
+// ========== 日程状态 ==========
+
+// 获取所有状态定义（含已停用），按排序顺序
+func getScheduleStatuses() ([]ScheduleStatus, error) {
+	rows, err := db.Query(`SELECT code, label, emoji, color, sort_order, active, is_off
+		FROM schedule_statuses ORDER BY sort_order, code`)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	result := make(map[string]int)
+	var statuses []ScheduleStatus
 	for rows.Next() {
-		var date string
-		var status int
-		rows.Scan(&date, &status)
-		result[date] = status
+		var st ScheduleStatus
+		rows.Scan(&st.Code, &st.Label, &st.Emoji, &st.Color, &st.SortOrder, &st.Active, &st.IsOff)
+		statuses = append(statuses, st)
 	}
-	return result, nil
+	return statuses, nil
 }
 
-func setSchedule(userID int, date string, status int) error {
+// 新建状态，编码自动分配
+func createScheduleStatus(label, emoji, color string, sortOrder int, isOff bool) error {
 	_, err := db.Exec(
-		`INSERT INTO schedules (user_id, date, status) VALUES (?, ?, ?)
-		 ON CONFLICT(user_id, date) DO UPDATE SET status = ?`,
-		userID, date, status, status,
+		`INSERT INTO schedule_statuses (code, label, emoji, color, sort_order, is_off)
+		 SELECT COALESCE(MAX(code), 0) + 1, ?, ?, ?, ?, ? FROM schedule_statuses`,
+		label, emoji, color, sortOrder, isOff,
 	)
 	return err
 }
 
-func getScheduleStatus(userID int, date string) int {
-	var status int
-	err := db.QueryRow("SELECT status FROM schedules WHERE user_id = ? AND date = ?", userID, date).Scan(&status)
-	if err != nil {
-		return StatusDefault
-	}
-	return status
+func updateScheduleStatus(code int, label, emoji, color string, sortOrder int, active, isOff bool) error {
+	_, err := db.Exec(
+		"UPDATE schedule_statuses SET label = ?, emoji = ?, color = ?, sort_order = ?, active = ?, is_off = ? WHERE code = ?",
+		label, emoji, color, sortOrder, active, isOff, code,
+	)
+	return err
 }
 
 func getUserByID(id int) (*User, error) {
 	u := &User{}
 	err := db.QueryRow(
-		"SELECT id, username, password, display_name, is_admin, created_at FROM users WHERE id = ?",
+		"SELECT id, username, password, display_name, is_admin, is_lead, created_at FROM users WHERE id = ?",
 		id,
-	).Scan(&u.ID, &u.Username, &u.Password, &u.DisplayName, &u.IsAdmin, &u.CreatedAt)
+	).Scan(&u.ID, &u.Username, &u.Password, &u.DisplayName, &u.IsAdmin, &u.IsLead, &u.CreatedAt)
 	if err != nil {
 		return nil, err
 	}
 	return u, nil
 }
 
-func updateUser(id int, displayName string, password string, isAdmin bool) error {
+func updateUser(id int, displayName string, password string, isAdmin, isLead bool) error {
 	if password != "" {
 		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 		if err != nil {
 			return err
 		}
 		_, err = db.Exec(
-			"UPDATE users SET display_name = ?, password = ?, is_admin = ? WHERE id = ?",
-			displayName, string(hash), isAdmin, id,
+			"UPDATE users SET display_name = ?, password = ?, is_admin = ?, is_lead = ? WHERE id = ?",
+			displayName, string(hash), isAdmin, isLead, id,
 		)
 		return err
 	}
 	_, err := db.Exec(
-		"UPDATE users SET display_name = ?, is_admin = ? WHERE id = ?",
-		displayName, isAdmin, id,
+		"UPDATE users SET display_name = ?, is_admin = ?, is_lead = ? WHERE id = ?",
+		displayName, isAdmin, isLead, id,
 	)
 	return err
 }
 
-func deleteUser(id int) error {
+// 删除用户，today 及之后的值班安排一并删除，之前的保留作记录；待确认的换班申请撤回
+func deleteUser(id int, today string) error {
 	// 先删除用户的日程数据
 	_, err := db.Exec("DELETE FROM schedules WHERE user_id = ?", id)
 	if err != nil {
 		return err
 	}
-	// 删除用户的 session
+	_, err = db.Exec("DELETE FROM schedule_rules WHERE user_id = ?", id)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE FROM schedule_notes WHERE user_id = ?", id)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE FROM schedule_comments WHERE user_id = ?", id)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE FROM user_group_members WHERE user_id = ?", id)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE FROM rotation_members WHERE user_id = ?", id)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE FROM rotation_shifts WHERE user_id = ? AND date >= ?", id, today)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE rotation_swaps SET status = ?, decided_at = CURRENT_TIMESTAMP WHERE (requester_id = ? OR target_id = ?) AND status = ?",
+		SwapCancelled, id, id, SwapPending)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE FROM leave_requests WHERE user_id = ?", id)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE FROM leave_quotas WHERE user_id = ?", id)
+	if err != nil {
+		return err
+	}
+	// 删除用户的 session 和日历订阅
 	deleteUserSessions(id)
+	revokeFeedToken(id)
 	// 再删除用户
 	_, err = db.Exec("DELETE FROM users WHERE id = ?", id)
 	return err
 }
 
+// 获取用户保存的 ICS 导入映射
+func getICSMapping(userID int) string {
+	var mapping string
+	db.QueryRow("SELECT ics_mapping FROM users WHERE id = ?", userID).Scan(&mapping)
+	return mapping
+}
+
+func setICSMapping(userID int, mapping string) error {
+	_, err := db.Exec("UPDATE users SET ics_mapping = ? WHERE id = ?", mapping, userID)
+	return err
+}
+
+// getCalendarPrefs 用户的日历显示设置，未设置的标签使用默认值
+func getCalendarPrefs(userID int) CalendarPrefs {
+	var weekStart, highlight int
+	var labels string
+	err := db.QueryRow("SELECT week_start, weekday_labels, highlight_weekday FROM users WHERE id = ?", userID).
+		Scan(&weekStart, &labels, &highlight)
+	if err != nil {
+		weekStart, highlight = 0, 5
+	}
+
+	prefs := CalendarPrefs{WeekStart: time.Weekday(weekStart), HighlightWeekday: highlight}
+	copy(prefs.WeekdayLabels[:], weekdayNames)
+	for i, label := range strings.Split(labels, ",") {
+		if label = strings.TrimSpace(label); i < 7 && label != "" {
+			prefs.WeekdayLabels[i] = label
+		}
+	}
+	return prefs
+}
+
+func setCalendarPrefs(userID int, prefs CalendarPrefs) error {
+	// 与默认相同的标签存为空，默认值调整后跟着变化
+	labels := make([]string, 7)
+	custom := false
+	for i, label := range prefs.WeekdayLabels {
+		if label != weekdayNames[i] {
+			labels[i] = label
+			custom = true
+		}
+	}
+	stored := ""
+	if custom {
+		stored = strings.Join(labels, ",")
+	}
+	_, err := db.Exec("UPDATE users SET week_start = ?, weekday_labels = ?, highlight_weekday = ? WHERE id = ?",
+		int(prefs.WeekStart), stored, prefs.HighlightWeekday, userID)
+	return err
+}
+
+func getUserTimezone(userID int) string {
+	var tz string
+	db.QueryRow("SELECT timezone FROM users WHERE id = ?", userID).Scan(&tz)
+	return tz
+}
+
+func setUserTimezone(userID int, tz string) error {
+	_, err := db.Exec("UPDATE users SET timezone = ? WHERE id = ?", tz, userID)
+	return err
+}
+
+// ========== 日历订阅 token ==========
+
+// 获取用户当前的订阅 token，未生成时返回空字符串
+func getFeedToken(userID int) string {
+	var token string
+	db.QueryRow("SELECT token FROM feed_tokens WHERE user_id = ?", userID).Scan(&token)
+	return token
+}
+
+// 重新生成订阅 token，旧 token 立即失效
+func resetFeedToken(userID int, token string) error {
+	_, err := db.Exec(
+		`INSERT INTO feed_tokens (token, user_id) VALUES (?, ?)
+		 ON CONFLICT(user_id) DO UPDATE SET token = excluded.token, created_at = CURRENT_TIMESTAMP`,
+		token, userID,
+	)
+	return err
+}
+
+func revokeFeedToken(userID int) error {
+	_, err := db.Exec("DELETE FROM feed_tokens WHERE user_id = ?", userID)
+	return err
+}
+
+// 根据订阅 token 查找用户
+func getUserIDByFeedToken(token string) (int, error) {
+	var userID int
+	err := db.QueryRow("SELECT user_id FROM feed_tokens WHERE token = ?", token).Scan(&userID)
+	return userID, err
+}
+
 // ========== 费用相关 ==========
 
 // UserExpenseInput 用户费用输入
@@ -212,52 +1815,74 @@ type UserExpenseInput struct {
 	DiscountRate  float64 // 折扣率
 }
 
-// 创建费用记录
-// totalUserCount 是包含admin在内的所有用户数（用于计算服务器费用分摊）
-func createExpenseRecord(startDate, endDate string, accountFee, serverFee float64, userInputs map[int]UserExpenseInput, totalUserCount int) (int64, error) {
-	result, err := db.Exec(
-		`INSERT INTO expense_records (start_date, end_date, account_fee, server_fee) VALUES (?, ?, ?, ?)`,
-		startDate, endDate, accountFee, serverFee,
-	)
+// TotalUsage 使用量 + 折扣使用量 × 折扣率
+func (in UserExpenseInput) TotalUsage() float64 {
+	return in.Usage + in.DiscountUsage*in.DiscountRate
+}
+
+// 创建费用记录，按分摊参数计算每个用户的费用，参数随记录保存
+func createExpenseRecord(startDate, endDate string, groupID int, params AllocationParams, userInputs map[int]UserExpenseInput) (int64, error) {
+	results, _, _, err := allocateExpense(params, userInputs)
 	if err != nil {
 		return 0, err
 	}
 
-	expenseID, err := result.LastInsertId()
+	tx, err := db.Begin()
 	if err != nil {
 		return 0, err
 	}
+	defer tx.Rollback()
 
-	// 确保用户数量至少为1
-	if totalUserCount == 0 {
-		totalUserCount = 1
+	result, err := tx.Exec(
+		`INSERT INTO expense_records (start_date, end_date, account_fee, server_fee, account_fee_cents, server_fee_cents,
+			strategy, unit_quota, amortize_months, tier_rate, head_count, formula_version, group_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		startDate, endDate, params.AccountFee.Yuan(), params.ServerFee.Yuan(), params.AccountFee, params.ServerFee,
+		params.Strategy, params.UnitQuota, params.AmortizeMonths, params.TierRate, params.headCount(len(userInputs)), AllocationFormulaVersion, groupID,
+	)
+	if err != nil {
+		return 0, err
 	}
 
-	// 计算每个用户的服务器费用分摊部分（所有用户平均分摊）
-	serverFeePerUser := serverFee / 12.0 / float64(totalUserCount)
+	expenseID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
 
 	// 保存每个用户的使用量和计算的费用
-	// 公式：使用量 / 2800 * 账号费用 + 服务器费用/12/用户数量
-	for userID, input := range userInputs {
-		totalUsage := input.Usage + input.DiscountUsage*input.DiscountRate
-		calculatedCost := totalUsage/2800.0*accountFee + serverFeePerUser
-
-		_, err = db.Exec(
-			`INSERT INTO expense_usages (expense_id, user_id, usage, supplement, calculated_cost, discount_usage, discount_rate) VALUES (?, ?, ?, ?, ?, ?, ?)`,
-			expenseID, userID, input.Usage, 0, calculatedCost, input.DiscountUsage, input.DiscountRate,
+	for _, res := range results {
+		input := userInputs[res.UserID]
+		_, err = tx.Exec(
+			`INSERT INTO expense_usages (expense_id, user_id, usage, supplement, calculated_cost, cost_cents, discount_usage, discount_rate)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			expenseID, res.UserID, input.Usage, 0, res.Cost.Yuan(), res.Cost, input.DiscountUsage, input.DiscountRate,
 		)
 		if err != nil {
 			return 0, err
 		}
 	}
 
-	return expenseID, nil
+	return expenseID, tx.Commit()
+}
+
+const expenseRecordColumns = `id, start_date, end_date, account_fee_cents, server_fee_cents, strategy, unit_quota, amortize_months, tier_rate,
+	head_count, formula_version, invoice_cents IS NOT NULL, COALESCE(invoice_cents, 0), remainder_mode,
+	group_id, COALESCE((SELECT name FROM user_groups g WHERE g.id = expense_records.group_id), ''), created_at`
+
+func scanExpenseRecord(row interface{ Scan(...interface{}) error }) (*ExpenseRecord, error) {
+	r := &ExpenseRecord{}
+	err := row.Scan(&r.ID, &r.StartDate, &r.EndDate, &r.AccountFee, &r.ServerFee,
+		&r.Strategy, &r.UnitQuota, &r.AmortizeMonths, &r.TierRate, &r.HeadCount, &r.FormulaVersion,
+		&r.Invoiced, &r.InvoiceTotal, &r.RemainderMode, &r.GroupID, &r.GroupName, &r.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
 }
 
 // 获取所有费用记录
 func getAllExpenseRecords() ([]ExpenseRecord, error) {
-	rows, err := db.Query(`SELECT id, start_date, end_date, account_fee, server_fee, created_at
-		FROM expense_records ORDER BY created_at DESC`)
+	rows, err := db.Query("SELECT " + expenseRecordColumns + " FROM expense_records ORDER BY created_at DESC, id DESC")
 	if err != nil {
 		return nil, err
 	}
@@ -265,47 +1890,90 @@ func getAllExpenseRecords() ([]ExpenseRecord, error) {
 
 	var records []ExpenseRecord
 	for rows.Next() {
-		var r ExpenseRecord
-		rows.Scan(&r.ID, &r.StartDate, &r.EndDate, &r.AccountFee, &r.ServerFee, &r.CreatedAt)
-		records = append(records, r)
+		if r, err := scanExpenseRecord(rows); err == nil {
+			records = append(records, *r)
+		}
 	}
 	return records, nil
 }
 
 // 获取费用记录详情
 func getExpenseRecordByID(id int) (*ExpenseRecord, error) {
-	r := &ExpenseRecord{}
-	err := db.QueryRow(
-		`SELECT id, start_date, end_date, account_fee, server_fee, created_at FROM expense_records WHERE id = ?`,
-		id,
-	).Scan(&r.ID, &r.StartDate, &r.EndDate, &r.AccountFee, &r.ServerFee, &r.CreatedAt)
+	return scanExpenseRecord(db.QueryRow("SELECT "+expenseRecordColumns+" FROM expense_records WHERE id = ?", id))
+}
+
+// 每条费用记录已分摊的费用合计
+func getExpenseCostTotals() (map[int]Cents, error) {
+	rows, err := db.Query("SELECT expense_id, COALESCE(SUM(cost_cents), 0) FROM expense_usages GROUP BY expense_id")
 	if err != nil {
 		return nil, err
 	}
-	return r, nil
+	defer rows.Close()
+
+	totals := make(map[int]Cents)
+	for rows.Next() {
+		var id int
+		var total Cents
+		rows.Scan(&id, &total)
+		totals[id] = total
+	}
+	return totals, nil
 }
 
-// 获取费用记录的用户使用量
-func getExpenseUsages(expenseID int) ([]ExpenseUsage, error) {
-	rows, err := db.Query(`
-		SELECT eu.id, eu.expense_id, eu.user_id, u.username, u.display_name,
-		       eu.usage, eu.discount_usage, eu.discount_rate, eu.calculated_cost
-		FROM expense_usages eu
-		LEFT JOIN users u ON eu.user_id = u.id
-		WHERE eu.expense_id = ?
-		ORDER BY eu.calculated_cost DESC
-	`, expenseID)
+// 该记录或同一范围内之后的记录是否已有人登记付款。
+// 发票金额和尾差处理方式会改变这些记录的应付金额，有付款后不再允许修改
+func expenseInvoiceLocked(id int) bool {
+	var count int
+	db.QueryRow(`SELECT COUNT(*) FROM expense_usages eu
+		JOIN expense_records r ON eu.expense_id = r.id
+		JOIN expense_records x ON x.id = ?
+		WHERE eu.paid_cents > 0 AND r.group_id = x.group_id
+		  AND (r.created_at > x.created_at OR (r.created_at = x.created_at AND r.id >= x.id))`, id).Scan(&count)
+	return count > 0
+}
+
+// getLockedExpenseRecords 所有被付款锁定的费用记录，判断方式与 expenseInvoiceLocked 相同
+func getLockedExpenseRecords() (map[int]bool, error) {
+	rows, err := db.Query(`SELECT x.id FROM expense_records x WHERE EXISTS (
+		SELECT 1 FROM expense_usages eu JOIN expense_records r ON eu.expense_id = r.id
+		WHERE eu.paid_cents > 0 AND r.group_id = x.group_id
+		  AND (r.created_at > x.created_at OR (r.created_at = x.created_at AND r.id >= x.id)))`)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	locked := make(map[int]bool)
+	for rows.Next() {
+		var id int
+		rows.Scan(&id)
+		locked[id] = true
+	}
+	return locked, nil
+}
+
+// 设置费用记录的发票金额和尾差处理方式，invoice 为 nil 时清除发票金额
+func setExpenseInvoice(id int, invoice *Cents, mode string) error {
+	var value interface{}
+	if invoice != nil {
+		value = int64(*invoice)
+	}
+	_, err := db.Exec("UPDATE expense_records SET invoice_cents = ?, remainder_mode = ? WHERE id = ?", value, mode, id)
+	return err
+}
+
+const expenseUsageColumns = `eu.id, eu.expense_id, eu.user_id, u.username, u.display_name,
+	eu.usage, eu.discount_usage, eu.discount_rate, eu.cost_cents,
+	eu.paid_cents, eu.paid_date, eu.pay_method, eu.pay_note`
+
+func scanExpenseUsages(rows *sql.Rows) []ExpenseUsage {
 	var usages []ExpenseUsage
 	for rows.Next() {
 		var eu ExpenseUsage
 		var username, displayName sql.NullString
 		rows.Scan(&eu.ID, &eu.ExpenseID, &eu.UserID, &username, &displayName,
-			&eu.Usage, &eu.DiscountUsage, &eu.DiscountRate, &eu.CalculatedCost)
+			&eu.Usage, &eu.DiscountUsage, &eu.DiscountRate, &eu.CalculatedCost,
+			&eu.PaidAmount, &eu.PaidDate, &eu.PayMethod, &eu.PayNote)
 		if username.Valid {
 			eu.Username = username.String
 		} else {
@@ -318,32 +1986,87 @@ func getExpenseUsages(expenseID int) ([]ExpenseUsage, error) {
 		}
 		usages = append(usages, eu)
 	}
-	return usages, nil
+	return usages
 }
 
-// 删除费用记录
-func deleteExpenseRecord(id int) error {
-	// 先删除使用量记录
-	_, err := db.Exec("DELETE FROM expense_usages WHERE expense_id = ?", id)
+// 获取费用记录的用户使用量
+func getExpenseUsages(expenseID int) ([]ExpenseUsage, error) {
+	rows, err := db.Query(`SELECT `+expenseUsageColumns+`
+		FROM expense_usages eu
+		LEFT JOIN users u ON eu.user_id = u.id
+		WHERE eu.expense_id = ?
+		ORDER BY eu.cost_cents DESC`, expenseID)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	// 再删除费用记录
-	_, err = db.Exec("DELETE FROM expense_records WHERE id = ?", id)
-	return err
+	defer rows.Close()
+	return scanExpenseUsages(rows), nil
 }
 
-// 获取最新的费用记录（用于自动计算下一个周期）
-func getLatestExpenseRecord() (*ExpenseRecord, error) {
-	r := &ExpenseRecord{}
-	err := db.QueryRow(
-		`SELECT id, start_date, end_date, account_fee, server_fee, created_at
-		FROM expense_records ORDER BY created_at DESC LIMIT 1`,
-	).Scan(&r.ID, &r.StartDate, &r.EndDate, &r.AccountFee, &r.ServerFee, &r.CreatedAt)
+// 一次查询所有费用记录的使用量，按记录 ID 分组。userID 不为 0 时只取该用户的，
+// 但按比例分摊尾差的记录需要全部用户的费用才能取整，仍然全部返回
+func getExpenseUsagesByRecord(userID int) (map[int][]ExpenseUsage, error) {
+	rows, err := db.Query(`SELECT `+expenseUsageColumns+`
+		FROM expense_usages eu
+		JOIN expense_records r ON eu.expense_id = r.id
+		LEFT JOIN users u ON eu.user_id = u.id
+		WHERE ? = 0 OR eu.user_id = ? OR (r.remainder_mode = ? AND r.invoice_cents IS NOT NULL)
+		ORDER BY eu.expense_id, eu.cost_cents DESC`, userID, userID, RemainderSpread)
 	if err != nil {
 		return nil, err
 	}
-	return r, nil
+	defer rows.Close()
+
+	result := make(map[int][]ExpenseUsage)
+	for _, eu := range scanExpenseUsages(rows) {
+		result[eu.ExpenseID] = append(result[eu.ExpenseID], eu)
+	}
+	return result, nil
+}
+
+// 登记某人某期的付款，返回所属的费用记录 ID
+func setExpensePayment(usageID int, paid Cents, paidDate, method, note string) (int, error) {
+	var expenseID int
+	if err := db.QueryRow("SELECT expense_id FROM expense_usages WHERE id = ?", usageID).Scan(&expenseID); err != nil {
+		return 0, err
+	}
+	_, err := db.Exec(
+		"UPDATE expense_usages SET paid_cents = ?, paid_date = ?, pay_method = ?, pay_note = ? WHERE id = ?",
+		paid, paidDate, method, note, usageID,
+	)
+	return expenseID, err
+}
+
+// 删除费用记录，已有用户登记付款时拒绝删除，避免付款记录随使用量一起丢失
+func deleteExpenseRecord(id int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var paid int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM expense_usages WHERE expense_id = ? AND paid_cents > 0", id).Scan(&paid); err != nil {
+		return err
+	}
+	if paid > 0 {
+		return fmt.Errorf("已有 %d 人登记付款，不能删除此记录", paid)
+	}
+
+	// 先删除使用量记录
+	if _, err := tx.Exec("DELETE FROM expense_usages WHERE expense_id = ?", id); err != nil {
+		return err
+	}
+	// 再删除费用记录
+	if _, err := tx.Exec("DELETE FROM expense_records WHERE id = ?", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// 获取某分组最新的费用记录（用于自动计算下一个周期），groupID 为 0 表示全部用户
+func getLatestExpenseRecord(groupID int) (*ExpenseRecord, error) {
+	return scanExpenseRecord(db.QueryRow("SELECT "+expenseRecordColumns+" FROM expense_records WHERE group_id = ? ORDER BY created_at DESC, id DESC LIMIT 1", groupID))
 }
 
 // ========== Session 持久化 ==========
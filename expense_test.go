@@ -0,0 +1,56 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// 已登记付款的费用记录不能删除，未付款的可以
+func TestDeleteExpenseRecordWithPayments(t *testing.T) {
+	initDB(filepath.Join(t.TempDir(), "expense.db"))
+	defer db.Close()
+
+	if err := createUser("bob", "p", "bob", false, false); err != nil {
+		t.Fatal(err)
+	}
+	bob, err := getUserByUsername("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := defaultAllocationParams()
+	p.HeadCount = 2
+	inputs := map[int]UserExpenseInput{bob.ID: {Usage: 100}}
+
+	paidID, err := createExpenseRecord("2026-01-01", "2026-01-31", 0, p, inputs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unpaidID, err := createExpenseRecord("2026-02-01", "2026-02-28", 0, p, inputs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usages, err := getExpenseUsages(int(paidID))
+	if err != nil || len(usages) != 1 {
+		t.Fatalf("usages = %v, %v", usages, err)
+	}
+	if _, err := setExpensePayment(usages[0].ID, 100, "2026-02-05", "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := deleteExpenseRecord(int(paidID)); err == nil {
+		t.Error("deleting a record with payments succeeded")
+	}
+	if _, err := getExpenseRecordByID(int(paidID)); err != nil {
+		t.Errorf("paid record is gone: %v", err)
+	}
+	if usages, _ := getExpenseUsages(int(paidID)); len(usages) != 1 {
+		t.Errorf("paid record has %d usages, want 1", len(usages))
+	}
+
+	if err := deleteExpenseRecord(int(unpaidID)); err != nil {
+		t.Errorf("deleting an unpaid record: %v", err)
+	}
+	if _, err := getExpenseRecordByID(int(unpaidID)); err == nil {
+		t.Error("unpaid record still exists")
+	}
+}
@@ -4,10 +4,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"html/template"
-	"math"
+	"io"
 	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 var templates map[string]*template.Template
@@ -22,26 +27,21 @@ func initTemplates() {
 			return s
 		},
 		"add": func(a, b int) int { return a + b },
-		"statusClass": func(s int) string {
-			switch s {
-			case StatusRest:
-				return "rest"
-			case StatusFire:
-				return "fire"
-			default:
-				return "default"
-			}
-		},
-		"statusLabel": func(s int) string {
-			switch s {
-			case StatusRest:
-				return "休"
-			case StatusFire:
-				return "🐮🐴"
-			default:
+		"weekdayName": func(date string, prefs CalendarPrefs) string {
+			d, err := time.Parse("2006-01-02", date)
+			if err != nil {
 				return ""
 			}
+			return prefs.DayName(d.Weekday())
 		},
+		"days":          formatDays,
+		"statusClass":   statusClass,
+		"statusLabel":   statusLabel,
+		"statusName":    statusName,
+		"dayLabel":      dayLabel,
+		"dayStatusName": dayStatusName,
+		"halfName":      halfName,
+		"weekdayMask":   weekdayMaskText,
 	}
 
 	templates = make(map[string]*template.Template)
@@ -53,8 +53,10 @@ func initTemplates() {
 
 	// 使用 layout 的页面，每个单独解析避免 content 定义冲突
 	layoutPages := []string{
-		"home.html", "admin.html", "admin_edit.html",
-		"expense.html", "expense_history.html", "expense_detail.html",
+		"home.html", "admin.html", "admin_edit.html", "rules.html", "settings.html",
+		"schedule_import.html", "stats.html", "team.html", "schedule_history.html",
+		"leave.html", "admin_leave.html", "schedule_day.html", "rotations.html", "admin_rotations.html",
+		"expense.html", "expense_history.html", "expense_detail.html", "expense_balance.html",
 	}
 	for _, page := range layoutPages {
 		templates[page] = template.Must(
@@ -108,13 +110,62 @@ type CalendarDay struct {
 	Day     int
 	Date    string
 	Status  int
+	Source  string // 状态来源：显式设置 / 节假日 / 周期规则
 	IsToday bool
+	Holiday *Holiday // 节假日或调休上班，普通日期为 nil
+	// 下午的状态，0 表示全天同一状态
+	PMStatus int
+	// 由他人代为修改时为修改人显示名称
+	EditedBy string
+	Note     string
+	Comments int // 评论数
+	// 有待审批的请假申请
+	LeavePending bool
+	// 在岗人数低于规则要求时的提示
+	Understaffed string
+	// 按个人设置高亮的星期
+	Highlight bool
+	// 星期标签，团队视图列头使用
+	WeekdayLabel string
+}
+
+// WeekdayHeader 月历的列头
+type WeekdayHeader struct {
+	Label     string
+	Highlight bool
+}
+
+// weekdayHeaders 按个人设置的每周第一天排列的列头
+func weekdayHeaders(prefs CalendarPrefs) []WeekdayHeader {
+	var headers []WeekdayHeader
+	for _, wd := range prefs.Columns() {
+		headers = append(headers, WeekdayHeader{Label: prefs.WeekdayLabels[wd], Highlight: prefs.Highlighted(wd)})
+	}
+	return headers
+}
+
+// understaffedNote 某用户某天所涉及规则的人数不足提示
+func understaffedNote(shortfalls map[string][]CoverageShortfall, date string, userID int) string {
+	var list []CoverageShortfall
+	for _, s := range shortfalls[date] {
+		if s.Covers(userID) {
+			list = append(list, s)
+		}
+	}
+	return coverageMessage(list)
+}
+
+// Split 上下午状态不同，格子分两半显示
+func (d CalendarDay) Split() bool {
+	return d.PMStatus != 0 && d.PMStatus != d.Status
 }
 
 type UserCalendar struct {
-	User    User
-	Weeks   [][]CalendarDay
-	IsOwner bool
+	User     User
+	Weeks    [][]CalendarDay
+	IsOwner  bool
+	Editable bool // 本人或管理员 / 组长
+	Balance  LeaveBalance
 }
 
 type HomeData struct {
@@ -125,13 +176,52 @@ type HomeData struct {
 	MonthName   string
 	PrevMonth   string
 	NextMonth   string
+	StatusMap   map[int]map[string]string // 供前端 JS 渲染状态
+	Statuses    []ScheduleStatus          // 可选状态（选择弹窗）
+	Groups      []Group
+	Group       *Group // 当前筛选的分组，nil 为全部
+	Weekdays    []WeekdayHeader
+}
+
+// viewerGroup 解析首页的分组筛选：带 group 参数时按该分组显示，同时带 remember=1（分组标签）时记为查看者的默认分组，
+// 否则使用上次选择的分组。返回当前分组（nil 为全部）及其成员
+func viewerGroup(r *http.Request, sess *Session) (*Group, []User) {
+	var group *Group
+	if slug := r.URL.Query().Get("group"); slug != "" {
+		if slug != "all" {
+			group, _ = getGroupBySlug(slug)
+		}
+		// 只有在分组标签中主动切换时才记住，分享的链接不改变对方的默认分组
+		if r.URL.Query().Get("remember") == "1" {
+			groupID := 0
+			if group != nil {
+				groupID = group.ID
+			}
+			setDefaultGroupID(sess.UserID, groupID)
+		}
+	} else if id := getDefaultGroupID(sess.UserID); id > 0 {
+		group, _ = getGroupByID(id)
+	}
+
+	groupID := 0
+	if group != nil {
+		groupID = group.ID
+	}
+	users, _ := getGroupUsers(groupID)
+	return group, users
 }
 
 func handleHome(w http.ResponseWriter, r *http.Request) {
 	sess := getSession(r)
 
+	// 周视图 / 日视图
+	if view := r.URL.Query().Get("view"); view == "week" || view == "day" {
+		handleTeamView(w, r, view)
+		return
+	}
+
 	// 解析月份参数
-	now := time.Now()
+	now := userNow(r)
 	todayStr := now.Format("2006-01-02")
 	year, month := now.Year(), int(now.Month())
 	if m := r.URL.Query().Get("month"); m != "" {
@@ -143,16 +233,23 @@ func handleHome(w http.ResponseWriter, r *http.Request) {
 	prev := t.AddDate(0, -1, 0)
 	next := t.AddDate(0, 1, 0)
 
-	users, _ := getAllUsers()
+	group, users := viewerGroup(r, sess)
+	groups, _ := getGroups()
+	holidays, _ := getHolidays(t, next.AddDate(0, 0, -1))
+	shortfalls, _ := findCoverageShortfalls(t, next.AddDate(0, 0, -1))
+	prefs := getCalendarPrefs(sess.UserID)
 
 	var calendars []UserCalendar
 	for _, u := range users {
 		monthStr := fmt.Sprintf("%04d-%02d", year, month)
 		schedules, _ := getSchedules(u.ID, monthStr)
+		pending, _ := getPendingLeaveDates(u.ID, t, next.AddDate(0, 0, -1))
+		notes, _ := getScheduleNotes(u.ID, t, next.AddDate(0, 0, -1))
+		comments, _ := getCommentCounts(u.ID, t, next.AddDate(0, 0, -1))
 
 		// 构建日历网格
 		firstDay := time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.Local)
-		weekday := int(firstDay.Weekday()) // 0=Sunday
+		weekday := prefs.Offset(firstDay.Weekday()) // 第一天所在的列
 		daysInMonth := time.Date(year, time.Month(month)+1, 0, 0, 0, 0, 0, time.Local).Day()
 
 		var days []CalendarDay
@@ -163,11 +260,22 @@ func handleHome(w http.ResponseWriter, r *http.Request) {
 		// 填充日期
 		for d := 1; d <= daysInMonth; d++ {
 			dateStr := fmt.Sprintf("%04d-%02d-%02d", year, month, d)
-			status := StatusDefault
+			wd := time.Date(year, time.Month(month), d, 0, 0, 0, 0, time.Local).Weekday()
+			day := CalendarDay{Day: d, Date: dateStr, Status: StatusDefault, IsToday: dateStr == todayStr, Highlight: prefs.Highlighted(wd)}
 			if s, ok := schedules[dateStr]; ok {
-				status = s
+				day.Status = s.Status
+				day.PMStatus = s.PMStatus
+				day.Source = s.Source
+				day.EditedBy = s.EditedBy
+			}
+			if h, ok := holidays[dateStr]; ok {
+				day.Holiday = &h
 			}
-			days = append(days, CalendarDay{Day: d, Date: dateStr, Status: status, IsToday: dateStr == todayStr})
+			day.LeavePending = pending[dateStr]
+			day.Note = notes[dateStr]
+			day.Comments = comments[dateStr]
+			day.Understaffed = understaffedNote(shortfalls, dateStr, u.ID)
+			days = append(days, day)
 		}
 		// 补齐最后一周
 		for len(days)%7 != 0 {
@@ -179,181 +287,1929 @@ func handleHome(w http.ResponseWriter, r *http.Request) {
 			weeks = append(weeks, days[i:i+7])
 		}
 
-		calendars = append(calendars, UserCalendar{
-			User:    u,
-			Weeks:   weeks,
-			IsOwner: u.ID == sess.UserID,
-		})
+		calendars = append(calendars, UserCalendar{
+			User:     u,
+			Weeks:    weeks,
+			IsOwner:  u.ID == sess.UserID,
+			Editable: canEditSchedule(sess, u.ID),
+			Balance:  getLeaveBalance(u.ID, year),
+		})
+	}
+
+	data := HomeData{
+		CurrentUser: sess,
+		Calendars:   calendars,
+		Year:        year,
+		Month:       month,
+		MonthName:   fmt.Sprintf("%d年%d月", year, month),
+		PrevMonth:   fmt.Sprintf("%04d-%02d", prev.Year(), int(prev.Month())),
+		NextMonth:   fmt.Sprintf("%04d-%02d", next.Year(), int(next.Month())),
+		StatusMap:   statusStyleMap(),
+		Statuses:    pickerStatuses(sess),
+		Groups:      groups,
+		Group:       group,
+		Weekdays:    weekdayHeaders(prefs),
+	}
+	renderTemplate(w, "home.html", data)
+}
+
+// 团队视图：用户为行、日期为列的紧凑矩阵
+type TeamViewRow struct {
+	User     User
+	IsOwner  bool
+	Editable bool
+	Days     []CalendarDay
+}
+
+// 某一天的团队概况
+type DaySummary struct {
+	Date    string
+	Working float64  // 半天休息计 0.5
+	Off     []string // 休息（计为不上班的状态）的人，附状态名
+	OnDuty  []string // 🐮🐴 的人
+}
+
+type TeamViewData struct {
+	CurrentUser *Session
+	View        string // week / day
+	Date        string
+	Title       string
+	Prev        string
+	Next        string
+	Columns     []CalendarDay // 列头日期
+	Rows        []TeamViewRow
+	Summary     DaySummary
+	StatusMap   map[int]map[string]string
+	Statuses    []ScheduleStatus
+	Groups      []Group
+	Group       *Group
+}
+
+func handleTeamView(w http.ResponseWriter, r *http.Request, view string) {
+	sess := getSession(r)
+
+	now := userNow(r)
+	todayStr := now.Format("2006-01-02")
+	date, err := time.Parse("2006-01-02", r.URL.Query().Get("date"))
+	if err != nil {
+		date, _ = time.Parse("2006-01-02", todayStr)
+	}
+
+	// 日视图只有一列，周视图从个人设置的每周第一天开始的 7 天
+	prefs := getCalendarPrefs(sess.UserID)
+	start, days, step := date, 1, 1
+	title := fmt.Sprintf("%d年%d月%d日 %s", date.Year(), int(date.Month()), date.Day(), prefs.DayName(date.Weekday()))
+	if view == "week" {
+		start = date.AddDate(0, 0, -prefs.Offset(date.Weekday()))
+		days, step = 7, 7
+		last := start.AddDate(0, 0, 6)
+		title = fmt.Sprintf("%s ~ %s", start.Format("2006-01-02"), last.Format("2006-01-02"))
+	}
+	end := start.AddDate(0, 0, days-1)
+
+	holidays, _ := getHolidays(start, end)
+	shortfalls, _ := findCoverageShortfalls(start, end)
+	var columns []CalendarDay
+	for i := 0; i < days; i++ {
+		d := start.AddDate(0, 0, i)
+		col := CalendarDay{Day: d.Day(), Date: d.Format("2006-01-02"), IsToday: d.Format("2006-01-02") == todayStr,
+			Highlight: prefs.Highlighted(d.Weekday()), WeekdayLabel: prefs.WeekdayLabels[d.Weekday()]}
+		if h, ok := holidays[col.Date]; ok {
+			col.Holiday = &h
+		}
+		col.Understaffed = coverageMessage(shortfalls[col.Date])
+		columns = append(columns, col)
+	}
+
+	summaryDate := date.Format("2006-01-02")
+	summary := DaySummary{Date: summaryDate}
+
+	group, users := viewerGroup(r, sess)
+	groups, _ := getGroups()
+	var rows []TeamViewRow
+	for _, u := range users {
+		schedules, _ := getSchedulesRange(u.ID, start, end)
+		pending, _ := getPendingLeaveDates(u.ID, start, end)
+		notes, _ := getScheduleNotes(u.ID, start, end)
+		comments, _ := getCommentCounts(u.ID, start, end)
+		row := TeamViewRow{User: u, IsOwner: u.ID == sess.UserID, Editable: canEditSchedule(sess, u.ID)}
+		for _, col := range columns {
+			day := col
+			day.Status = StatusDefault
+			if s, ok := schedules[col.Date]; ok {
+				day.Status = s.Status
+				day.PMStatus = s.PMStatus
+				day.Source = s.Source
+				day.EditedBy = s.EditedBy
+			}
+			day.LeavePending = pending[col.Date]
+			day.Note = notes[col.Date]
+			day.Comments = comments[col.Date]
+			day.Understaffed = understaffedNote(shortfalls, col.Date, u.ID)
+			row.Days = append(row.Days, day)
+
+			if col.Date == summaryDate {
+				am, pm := DaySchedule{Status: day.Status, PMStatus: day.PMStatus}.Halves()
+				switch {
+				case isOffStatus(am) && isOffStatus(pm):
+					summary.Off = append(summary.Off, u.DisplayName+"（"+dayStatusName(am, pm)+"）")
+				case isOffStatus(am) || isOffStatus(pm):
+					// 半天休息，计为在岗半天
+					summary.Off = append(summary.Off, u.DisplayName+"（"+dayStatusName(am, pm)+"）")
+					summary.Working += 0.5
+				default:
+					summary.Working++
+				}
+				if am == StatusFire || pm == StatusFire {
+					summary.OnDuty = append(summary.OnDuty, u.DisplayName)
+				}
+			}
+		}
+		rows = append(rows, row)
+	}
+
+	renderTemplate(w, "team.html", TeamViewData{
+		CurrentUser: sess,
+		View:        view,
+		Date:        summaryDate,
+		Title:       title,
+		Prev:        date.AddDate(0, 0, -step).Format("2006-01-02"),
+		Next:        date.AddDate(0, 0, step).Format("2006-01-02"),
+		Columns:     columns,
+		Rows:        rows,
+		Summary:     summary,
+		StatusMap:   statusStyleMap(),
+		Statuses:    pickerStatuses(sess),
+		Groups:      groups,
+		Group:       group,
+	})
+}
+
+// pickerStatuses 日历选择弹窗中的状态，需要请假审批的状态不直接提供
+func pickerStatuses(sess *Session) []ScheduleStatus {
+	var list []ScheduleStatus
+	for _, st := range activeStatuses() {
+		if !needsLeaveApproval(sess, st.Code) {
+			list = append(list, st)
+		}
+	}
+	return list
+}
+
+// 更新日程状态
+func handleScheduleUpdate(w http.ResponseWriter, r *http.Request) {
+	sess := getSession(r)
+	date := r.FormValue("date")
+	userID, _ := strconv.Atoi(r.FormValue("user_id"))
+
+	if !canEditSchedule(sess, userID) {
+		http.Error(w, "无权操作", http.StatusForbidden)
+		return
+	}
+
+	if _, err := time.Parse("2006-01-02", date); err != nil {
+		http.Error(w, "日期格式错误", http.StatusBadRequest)
+		return
+	}
+
+	half := r.FormValue("half")
+	if half != "" && half != HalfAM && half != HalfPM {
+		http.Error(w, "半天参数错误", http.StatusBadRequest)
+		return
+	}
+
+	var next int
+	if s := r.FormValue("status"); s != "" {
+		// 直接指定状态
+		code, err := parseStatusCode(s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		next = code
+	} else {
+		// 未指定时循环切换状态，跳过需要审批的状态
+		am, pm := getDaySchedule(userID, date).Halves()
+		current := am
+		if half == HalfPM {
+			current = pm
+		}
+		next = nextStatus(current)
+		if needsLeaveApproval(sess, next) {
+			next = nextStatus(next)
+		}
+	}
+	if needsLeaveApproval(sess, next) {
+		http.Error(w, leaveRequiredMsg, http.StatusForbidden)
+		return
+	}
+
+	// 修改后的上下午状态，用于检查在岗人数
+	newAM, newPM := next, next
+	if half != "" {
+		am, pm := getDaySchedule(userID, date).Halves()
+		if half == HalfAM {
+			newPM = pm
+		} else {
+			newAM = am
+		}
+	}
+	var warnings []string
+	msg, rejected := coverageWarning(sess, userID, map[string][2]int{date: {newAM, newPM}})
+	if rejected {
+		http.Error(w, msg, http.StatusConflict)
+		return
+	}
+	if msg != "" {
+		warnings = append(warnings, msg)
+	}
+
+	am, pm := next, next
+	var err error
+	if half == "" {
+		err = setSchedule(userID, date, next, sess.UserID)
+	} else {
+		am, pm, err = setScheduleHalf(userID, date, half, next, sess.UserID)
+	}
+	if err != nil {
+		http.Error(w, "保存失败", http.StatusInternalServerError)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"status":    am,
+		"pm_status": pm,
+		"date":      date,
+		"edited_by": editorName(sess, userID),
+	}
+	if next == StatusRest {
+		d, _ := time.Parse("2006-01-02", date)
+		if msg := leaveQuotaWarning(userID, d, d); msg != "" {
+			warnings = append(warnings, msg)
+		}
+	}
+	if len(warnings) > 0 {
+		resp["warning"] = strings.Join(warnings, "\n")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+const leaveRequiredMsg = "休息需要提交请假申请，审批通过后自动写入"
+
+// coverageWarning 检查修改是否会让在岗人数低于规则下限。
+// 命中强制规则时返回 rejected（管理员不受限制，只提醒），否则返回提醒文字
+func coverageWarning(sess *Session, userID int, changes map[string][2]int) (msg string, rejected bool) {
+	enforced, warned, _ := checkCoverage(userID, changes)
+	if len(enforced) > 0 {
+		if !sess.IsAdmin {
+			return "在岗人数不足，不能修改：" + coverageMessage(enforced), true
+		}
+		warned = append(enforced, warned...)
+	}
+	if len(warned) > 0 {
+		return "修改后在岗人数不足：" + coverageMessage(warned), false
+	}
+	return "", false
+}
+
+// editorName 代他人修改时返回操作人显示名称，修改自己的日程返回空
+func editorName(sess *Session, userID int) string {
+	if sess.UserID == userID {
+		return ""
+	}
+	if u, err := getUserByID(sess.UserID); err == nil {
+		return u.DisplayName
+	}
+	return sess.Username
+}
+
+// 批量设置日期范围的状态最多覆盖的天数
+const MaxScheduleRangeDays = 366
+
+// parseDateRange 解析起止日期（YYYY-MM-DD），要求 start <= end
+func parseDateRange(startStr, endStr string) (time.Time, time.Time, error) {
+	start, err := time.Parse("2006-01-02", startStr)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("开始日期格式错误")
+	}
+	end, err := time.Parse("2006-01-02", endStr)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("结束日期格式错误")
+	}
+	if end.Before(start) {
+		return time.Time{}, time.Time{}, fmt.Errorf("结束日期不能早于开始日期")
+	}
+	return start, end, nil
+}
+
+// 批量设置日期范围的状态
+// weekdays 为可选的星期掩码：bit0=周日 ... bit6=周六，为空或 0 表示每天
+func handleScheduleRange(w http.ResponseWriter, r *http.Request) {
+	sess := getSession(r)
+	userID, _ := strconv.Atoi(r.FormValue("user_id"))
+
+	if !canEditSchedule(sess, userID) {
+		http.Error(w, "无权操作", http.StatusForbidden)
+		return
+	}
+
+	start, end, err := parseDateRange(r.FormValue("start"), r.FormValue("end"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if end.Sub(start).Hours()/24 >= MaxScheduleRangeDays {
+		http.Error(w, fmt.Sprintf("日期范围不能超过 %d 天", MaxScheduleRangeDays), http.StatusBadRequest)
+		return
+	}
+
+	status, err := parseStatusCode(r.FormValue("status"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if needsLeaveApproval(sess, status) {
+		http.Error(w, leaveRequiredMsg, http.StatusForbidden)
+		return
+	}
+
+	mask, _ := strconv.Atoi(r.FormValue("weekdays"))
+	if mask <= 0 {
+		mask = 0b1111111
+	}
+
+	entries := make(map[string]int)
+	dates := []string{}
+	for d := start; !d.After(end); d = d.AddDate(0, 0, 1) {
+		if mask&(1<<int(d.Weekday())) == 0 {
+			continue
+		}
+		date := d.Format("2006-01-02")
+		entries[date] = status
+		dates = append(dates, date)
+	}
+
+	changes := make(map[string][2]int)
+	for date := range entries {
+		changes[date] = [2]int{status, status}
+	}
+	var warnings []string
+	msg, rejected := coverageWarning(sess, userID, changes)
+	if rejected {
+		http.Error(w, msg, http.StatusConflict)
+		return
+	}
+	if msg != "" {
+		warnings = append(warnings, msg)
+	}
+
+	if err := setSchedules(userID, entries, sess.UserID); err != nil {
+		http.Error(w, "保存失败", http.StatusInternalServerError)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"status":    status,
+		"pm_status": status,
+		"dates":     dates,
+		"edited_by": editorName(sess, userID),
+	}
+	if status == StatusRest {
+		if msg := leaveQuotaWarning(userID, start, end); msg != "" {
+			warnings = append(warnings, msg)
+		}
+	}
+	if len(warnings) > 0 {
+		resp["warning"] = strings.Join(warnings, "\n")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// ========== 变更记录 ==========
+
+// 变更记录最多显示的条数
+const ScheduleHistoryLimit = 500
+
+// 某用户的日程变更记录，可按月份筛选
+func handleScheduleHistory(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.URL.Query().Get("user_id"))
+	if err != nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	user, err := getUserByID(userID)
+	if err != nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	month := r.URL.Query().Get("month")
+	if _, err := time.Parse("2006-01", month); err != nil {
+		month = ""
+	}
+	changes, _ := getScheduleChanges(userID, month, ScheduleHistoryLimit)
+
+	renderTemplate(w, "schedule_history.html", map[string]interface{}{
+		"CurrentUser": getSession(r),
+		"User":        user,
+		"Month":       month,
+		"Changes":     changes,
+	})
+}
+
+// ========== 备注与评论 ==========
+
+// 备注和评论的最大长度（字符）
+const (
+	MaxNoteLength    = 100
+	MaxCommentLength = 500
+)
+
+// 某人某天的详情：状态、备注和评论
+func handleScheduleDay(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.URL.Query().Get("user_id"))
+	renderScheduleDay(w, r, userID, r.URL.Query().Get("date"), "")
+}
+
+func renderScheduleDay(w http.ResponseWriter, r *http.Request, userID int, date, errMsg string) {
+	sess := getSession(r)
+	user, err := getUserByID(userID)
+	if err != nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	if _, err := time.Parse("2006-01-02", date); err != nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	comments, _ := getScheduleComments(userID, date)
+	markDeletableComments(comments, sess)
+	renderTemplate(w, "schedule_day.html", map[string]interface{}{
+		"CurrentUser": sess,
+		"User":        user,
+		"Date":        date,
+		"Schedule":    getDaySchedule(userID, date),
+		"Note":        getScheduleNote(userID, date),
+		"Comments":    comments,
+		"CanEdit":     canEditSchedule(sess, userID),
+		"MaxNote":     MaxNoteLength,
+		"MaxComment":  MaxCommentLength,
+		"Error":       errMsg,
+		"Prefs":       getCalendarPrefs(sess.UserID),
+	})
+}
+
+func markDeletableComments(comments []*ScheduleComment, sess *Session) {
+	for _, c := range comments {
+		c.Deletable = c.AuthorID == sess.UserID || sess.IsAdmin
+		markDeletableComments(c.Replies, sess)
+	}
+}
+
+func scheduleDayURL(userID int, date string) string {
+	return fmt.Sprintf("/schedule/day?user_id=%d&date=%s", userID, date)
+}
+
+// 设置备注，留空删除
+func handleScheduleNote(w http.ResponseWriter, r *http.Request) {
+	sess := getSession(r)
+	userID, _ := strconv.Atoi(r.FormValue("user_id"))
+	date := r.FormValue("date")
+	if !canEditSchedule(sess, userID) {
+		http.Error(w, "无权操作", http.StatusForbidden)
+		return
+	}
+	if _, err := time.Parse("2006-01-02", date); err != nil {
+		http.Error(w, "日期格式错误", http.StatusBadRequest)
+		return
+	}
+
+	note := strings.TrimSpace(r.FormValue("note"))
+	if utf8.RuneCountInString(note) > MaxNoteLength {
+		renderScheduleDay(w, r, userID, date, fmt.Sprintf("备注不能超过 %d 个字", MaxNoteLength))
+		return
+	}
+	if err := setScheduleNote(userID, date, note); err != nil {
+		renderScheduleDay(w, r, userID, date, "保存失败")
+		return
+	}
+	http.Redirect(w, r, scheduleDayURL(userID, date), http.StatusFound)
+}
+
+// 发表评论或回复
+func handleScheduleComment(w http.ResponseWriter, r *http.Request) {
+	sess := getSession(r)
+	userID, _ := strconv.Atoi(r.FormValue("user_id"))
+	date := r.FormValue("date")
+	if _, err := getUserByID(userID); err != nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	if _, err := time.Parse("2006-01-02", date); err != nil {
+		http.Error(w, "日期格式错误", http.StatusBadRequest)
+		return
+	}
+
+	body := strings.TrimSpace(r.FormValue("body"))
+	if body == "" {
+		renderScheduleDay(w, r, userID, date, "评论内容不能为空")
+		return
+	}
+	if utf8.RuneCountInString(body) > MaxCommentLength {
+		renderScheduleDay(w, r, userID, date, fmt.Sprintf("评论不能超过 %d 个字", MaxCommentLength))
+		return
+	}
+
+	// 回复只能针对同一天的评论
+	parentID, _ := strconv.Atoi(r.FormValue("parent_id"))
+	if parentID != 0 {
+		parent, err := getScheduleCommentByID(parentID)
+		if err != nil || parent.UserID != userID || parent.Date != date {
+			renderScheduleDay(w, r, userID, date, "回复的评论不存在")
+			return
+		}
+	}
+
+	if err := createScheduleComment(userID, date, sess.UserID, parentID, body); err != nil {
+		renderScheduleDay(w, r, userID, date, "保存失败")
+		return
+	}
+	http.Redirect(w, r, scheduleDayURL(userID, date), http.StatusFound)
+}
+
+// 删除评论，作者本人或管理员
+func handleScheduleCommentDelete(w http.ResponseWriter, r *http.Request) {
+	sess := getSession(r)
+	id, _ := strconv.Atoi(r.FormValue("id"))
+	c, err := getScheduleCommentByID(id)
+	if err != nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	if c.AuthorID != sess.UserID && !sess.IsAdmin {
+		http.Error(w, "无权操作", http.StatusForbidden)
+		return
+	}
+	deleteScheduleComment(id)
+	http.Redirect(w, r, scheduleDayURL(c.UserID, c.Date), http.StatusFound)
+}
+
+// ========== 统计 ==========
+
+// 统计参数：period=month|quarter|year，date=YYYY-MM（周期内任一月份）
+func statsParams(r *http.Request) (string, string) {
+	period := r.URL.Query().Get("period")
+	if period == "" {
+		period = PeriodMonth
+	}
+	anchor := r.URL.Query().Get("date")
+	if anchor == "" {
+		anchor = userNow(r).Format("2006-01")
+	}
+	return period, anchor
+}
+
+// 统计页面
+func handleStatsPage(w http.ResponseWriter, r *http.Request) {
+	sess := getSession(r)
+	prefs := getCalendarPrefs(sess.UserID)
+	period, anchor := statsParams(r)
+	stats, err := buildStats(period, anchor, prefs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	renderTemplate(w, "stats.html", map[string]interface{}{
+		"CurrentUser": sess,
+		"Stats":       stats,
+		"Anchor":      anchor,
+		"Weekdays":    weekdayHeaders(prefs),
+	})
+}
+
+// 统计数据（JSON）
+func handleStatsJSON(w http.ResponseWriter, r *http.Request) {
+	period, anchor := statsParams(r)
+	stats, err := buildStats(period, anchor, getCalendarPrefs(getSession(r).UserID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// ========== ICS 导入 ==========
+
+// 单次导入最多写入的天数
+const MaxImportDays = 1000
+
+// 导入预览中的一行
+type ImportChange struct {
+	Date      string
+	Summary   string
+	OldStatus int
+	NewStatus int
+}
+
+// ICS 导入页面
+func handleScheduleImportPage(w http.ResponseWriter, r *http.Request) {
+	sess := getSession(r)
+	mapping := getICSMapping(sess.UserID)
+	if mapping == "" {
+		mapping = defaultICSMapping()
+	}
+	renderTemplate(w, "schedule_import.html", map[string]interface{}{
+		"CurrentUser": sess,
+		"Mapping":     mapping,
+	})
+}
+
+func renderImportError(w http.ResponseWriter, r *http.Request, mapping, errMsg string) {
+	renderTemplate(w, "schedule_import.html", map[string]interface{}{
+		"CurrentUser": getSession(r),
+		"Mapping":     mapping,
+		"Error":       errMsg,
+	})
+}
+
+// ICS 导入：action=preview 解析文件并预览变更，action=apply 确认后在同一事务中写入
+func handleScheduleImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		handleScheduleImportPage(w, r)
+		return
+	}
+	if r.FormValue("action") == "apply" {
+		applyScheduleImport(w, r)
+		return
+	}
+
+	sess := getSession(r)
+	mappingText := r.FormValue("mapping")
+	rules, err := parseICSMapping(mappingText)
+	if err != nil {
+		renderImportError(w, r, mappingText, err.Error())
+		return
+	}
+
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		renderImportError(w, r, mappingText, "请选择 .ics 文件")
+		return
+	}
+	defer file.Close()
+
+	events, err := parseICS(io.LimitReader(file, 5<<20))
+	if err != nil {
+		renderImportError(w, r, mappingText, "解析失败："+err.Error())
+		return
+	}
+
+	// 同一天有多个事件时，后出现的覆盖前面的
+	newStatus := make(map[string]int)
+	summaries := make(map[string]string)
+	for _, e := range events {
+		status, ok := e.matchStatus(rules)
+		if !ok {
+			continue
+		}
+		for _, date := range e.Dates() {
+			newStatus[date] = status
+			summaries[date] = e.Summary
+		}
+	}
+	if len(newStatus) > MaxImportDays {
+		renderImportError(w, r, mappingText, fmt.Sprintf("匹配到的日期超过 %d 天，请缩小文件范围", MaxImportDays))
+		return
+	}
+
+	setICSMapping(sess.UserID, mappingText)
+
+	// 一次查询出导入范围内的现有日程
+	var minDate, maxDate string
+	for date := range newStatus {
+		if minDate == "" || date < minDate {
+			minDate = date
+		}
+		if date > maxDate {
+			maxDate = date
+		}
+	}
+	current := make(map[string]DaySchedule)
+	if minDate != "" {
+		start, err1 := time.Parse("2006-01-02", minDate)
+		end, err2 := time.Parse("2006-01-02", maxDate)
+		if err1 == nil && err2 == nil {
+			current, _ = getSchedulesRange(sess.UserID, start, end)
+		}
+	}
+
+	var changes []ImportChange
+	unchanged, needLeave := 0, 0
+	for date, status := range newStatus {
+		if needsLeaveApproval(sess, status) {
+			needLeave++
+			continue
+		}
+		old := StatusDefault
+		if s, ok := current[date]; ok {
+			old = s.Status
+		}
+		if old == status {
+			unchanged++
+			continue
+		}
+		changes = append(changes, ImportChange{Date: date, Summary: summaries[date], OldStatus: old, NewStatus: status})
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Date < changes[j].Date })
+
+	// 在岗人数规则与直接修改日程相同，预览时先提示，确认导入时再检查一次
+	entries := make(map[string]int)
+	for _, c := range changes {
+		entries[c.Date] = c.NewStatus
+	}
+	coverageMsg, coverageRejected := coverageWarning(sess, sess.UserID, importCoverageChanges(entries))
+
+	renderTemplate(w, "schedule_import.html", map[string]interface{}{
+		"CurrentUser":      sess,
+		"Mapping":          mappingText,
+		"Preview":          true,
+		"EventCount":       len(events),
+		"Changes":          changes,
+		"Unchanged":        unchanged,
+		"NeedLeave":        needLeave,
+		"Coverage":         coverageMsg,
+		"CoverageRejected": coverageRejected,
+	})
+}
+
+// importCoverageChanges 导入的日期都按全天设置，转换为在岗人数检查需要的上下午状态
+func importCoverageChanges(entries map[string]int) map[string][2]int {
+	changes := make(map[string][2]int)
+	for date, status := range entries {
+		changes[date] = [2]int{status, status}
+	}
+	return changes
+}
+
+// 确认导入，entry 格式为 "YYYY-MM-DD:状态编码"
+func applyScheduleImport(w http.ResponseWriter, r *http.Request) {
+	sess := getSession(r)
+	r.ParseForm()
+
+	entries := make(map[string]int)
+	for _, entry := range r.Form["entry"] {
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", parts[0]); err != nil {
+			renderImportError(w, r, r.FormValue("mapping"), "日期格式错误："+parts[0])
+			return
+		}
+		status, err := parseStatusCode(parts[1])
+		if err != nil {
+			renderImportError(w, r, r.FormValue("mapping"), err.Error())
+			return
+		}
+		if needsLeaveApproval(sess, status) {
+			renderImportError(w, r, r.FormValue("mapping"), leaveRequiredMsg)
+			return
+		}
+		entries[parts[0]] = status
+	}
+	if len(entries) == 0 || len(entries) > MaxImportDays {
+		renderImportError(w, r, r.FormValue("mapping"), "没有需要导入的日期")
+		return
+	}
+	if msg, rejected := coverageWarning(sess, sess.UserID, importCoverageChanges(entries)); rejected {
+		renderImportError(w, r, r.FormValue("mapping"), msg)
+		return
+	}
+
+	if err := setSchedules(sess.UserID, entries, sess.UserID); err != nil {
+		renderImportError(w, r, r.FormValue("mapping"), "导入失败："+err.Error())
+		return
+	}
+
+	// 跳转到最早导入日期所在月份
+	first := ""
+	for date := range entries {
+		if first == "" || date < first {
+			first = date
+		}
+	}
+	http.Redirect(w, r, "/?month="+first[:7], http.StatusFound)
+}
+
+// ========== 周期规则 ==========
+
+var weekdayNames = []string{"日", "一", "二", "三", "四", "五", "六"}
+
+// weekdayMaskText 把星期掩码显示为 "周一、周三"，使用个人设置的星期标签
+func weekdayMaskText(mask int, prefs CalendarPrefs) string {
+	var names []string
+	for i, name := range prefs.DayNames() {
+		if mask&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, "、")
+}
+
+// 周期规则页面
+func handleRulesPage(w http.ResponseWriter, r *http.Request) {
+	renderRulesPage(w, r, "")
+}
+
+func renderRulesPage(w http.ResponseWriter, r *http.Request, errMsg string) {
+	sess := getSession(r)
+	rules, _ := getScheduleRules(sess.UserID)
+	prefs := getCalendarPrefs(sess.UserID)
+
+	// 规则只用于非默认状态。周期规则是固定作息（如大小周）而不是请假，休息也可以直接设置
+	var statuses []ScheduleStatus
+	for _, st := range activeStatuses() {
+		if st.Code != StatusDefault {
+			statuses = append(statuses, st)
+		}
+	}
+
+	renderTemplate(w, "rules.html", map[string]interface{}{
+		"CurrentUser": sess,
+		"Rules":       rules,
+		"Statuses":    statuses,
+		"Weekdays":    prefs.DayNames(),
+		"Prefs":       prefs,
+		"Today":       userNow(r).Format("2006-01-02"),
+		"Error":       errMsg,
+	})
+}
+
+// 添加周期规则
+func handleRuleAdd(w http.ResponseWriter, r *http.Request) {
+	sess := getSession(r)
+	r.ParseForm()
+
+	status, err := parseStatusCode(r.FormValue("status"))
+	if err != nil || status == StatusDefault {
+		renderRulesPage(w, r, "请选择状态")
+		return
+	}
+
+	mask := 0
+	for _, v := range r.Form["weekday"] {
+		if i, err := strconv.Atoi(v); err == nil && i >= 0 && i < 7 {
+			mask |= 1 << i
+		}
+	}
+	if mask == 0 {
+		renderRulesPage(w, r, "请至少选择一个星期")
+		return
+	}
+
+	interval, _ := strconv.Atoi(r.FormValue("interval_weeks"))
+	if interval < 1 {
+		interval = 1
+	}
+
+	startDate := r.FormValue("start_date")
+	endDate := r.FormValue("end_date")
+	if endDate != "" {
+		if _, _, err := parseDateRange(startDate, endDate); err != nil {
+			renderRulesPage(w, r, err.Error())
+			return
+		}
+	} else if _, err := time.Parse("2006-01-02", startDate); err != nil {
+		renderRulesPage(w, r, "开始日期格式错误")
+		return
+	}
+
+	err = createScheduleRule(ScheduleRule{
+		UserID:        sess.UserID,
+		Status:        status,
+		Weekdays:      mask,
+		IntervalWeeks: interval,
+		StartDate:     startDate,
+		EndDate:       endDate,
+	})
+	if err != nil {
+		renderRulesPage(w, r, "保存失败")
+		return
+	}
+
+	http.Redirect(w, r, "/rules", http.StatusFound)
+}
+
+// 删除周期规则
+func handleRuleDelete(w http.ResponseWriter, r *http.Request) {
+	sess := getSession(r)
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err == nil {
+		deleteScheduleRule(id, sess.UserID)
+	}
+	http.Redirect(w, r, "/rules", http.StatusFound)
+}
+
+// ========== 请假申请 ==========
+
+// 审批页显示的最近已审批申请条数
+const LeaveHistoryLimit = 50
+
+// 我的请假申请
+func handleLeavePage(w http.ResponseWriter, r *http.Request) {
+	renderLeavePage(w, r, "", "")
+}
+
+func renderLeavePage(w http.ResponseWriter, r *http.Request, errMsg, warnMsg string) {
+	sess := getSession(r)
+	requests, _ := getUserLeaveRequests(sess.UserID)
+	now := userNow(r)
+
+	renderTemplate(w, "leave.html", map[string]interface{}{
+		"CurrentUser": sess,
+		"Requests":    requests,
+		"Balance":     getLeaveBalance(sess.UserID, now.Year()),
+		"Today":       now.Format("2006-01-02"),
+		"Error":       errMsg,
+		"Warning":     warnMsg,
+	})
+}
+
+// leaveQuotaWarning 日期范围涉及的年份中，已用连同待审批超出年假额度时返回提醒
+func leaveQuotaWarning(userID int, start, end time.Time) string {
+	var msgs []string
+	for year := start.Year(); year <= end.Year(); year++ {
+		b := getLeaveBalance(userID, year)
+		over := b.Over()
+		if over <= 0 {
+			continue
+		}
+		msg := fmt.Sprintf("%d 年年假额度 %s 天，已用 %s 天", year, formatDays(b.Quota), formatDays(b.Used))
+		if b.Pending > 0 {
+			msg += fmt.Sprintf("，待审批 %s 天", formatDays(b.Pending))
+		}
+		msgs = append(msgs, msg+fmt.Sprintf("，超出 %s 天", formatDays(over)))
+	}
+	return strings.Join(msgs, "；")
+}
+
+// formatDays 天数显示，整数不带小数点
+func formatDays(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// 提交请假申请
+func handleLeaveSubmit(w http.ResponseWriter, r *http.Request) {
+	sess := getSession(r)
+	startDate := r.FormValue("start_date")
+	endDate := r.FormValue("end_date")
+	reason := strings.TrimSpace(r.FormValue("reason"))
+
+	start, end, err := parseDateRange(startDate, endDate)
+	if err != nil {
+		renderLeavePage(w, r, err.Error(), "")
+		return
+	}
+	if end.Sub(start).Hours()/24 >= MaxScheduleRangeDays {
+		renderLeavePage(w, r, fmt.Sprintf("请假不能超过 %d 天", MaxScheduleRangeDays), "")
+		return
+	}
+	if hasOverlappingLeave(sess.UserID, startDate, endDate) {
+		renderLeavePage(w, r, "与已有的待审批或已批准申请日期重叠", "")
+		return
+	}
+
+	if err := createLeaveRequest(sess.UserID, startDate, endDate, reason); err != nil {
+		renderLeavePage(w, r, "提交失败", "")
+		return
+	}
+	// 超出年假额度时仍然提交，由审批人决定
+	if msg := leaveQuotaWarning(sess.UserID, start, end); msg != "" {
+		renderLeavePage(w, r, "", "申请已提交，但 "+msg)
+		return
+	}
+	http.Redirect(w, r, "/leave", http.StatusFound)
+}
+
+// 撤回待审批的申请
+func handleLeaveCancel(w http.ResponseWriter, r *http.Request) {
+	sess := getSession(r)
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err == nil {
+		cancelLeaveRequest(id, sess.UserID)
+	}
+	http.Redirect(w, r, "/leave", http.StatusFound)
+}
+
+// 请假审批队列
+func handleLeaveQueue(w http.ResponseWriter, r *http.Request) {
+	renderLeaveQueue(w, r, "", "")
+}
+
+func renderLeaveQueue(w http.ResponseWriter, r *http.Request, errMsg, successMsg string) {
+	sess := getSession(r)
+	pending, _ := getPendingLeaveRequests()
+	decided, _ := getDecidedLeaveRequests(LeaveHistoryLimit)
+
+	// 超出年假额度或会让在岗人数不足的申请给出提醒
+	warnings := make(map[int]string)
+	for _, lr := range pending {
+		start, end, err := parseDateRange(lr.StartDate, lr.EndDate)
+		if err != nil {
+			continue
+		}
+		var msgs []string
+		if msg := leaveQuotaWarning(lr.UserID, start, end); msg != "" {
+			msgs = append(msgs, msg)
+		}
+		changes := make(map[string][2]int)
+		for d := start; !d.After(end); d = d.AddDate(0, 0, 1) {
+			changes[d.Format("2006-01-02")] = [2]int{StatusRest, StatusRest}
+		}
+		if enforced, warned, _ := checkCoverage(lr.UserID, changes); len(enforced)+len(warned) > 0 {
+			msgs = append(msgs, "批准后在岗人数不足："+coverageMessage(append(enforced, warned...)))
+		}
+		if len(msgs) > 0 {
+			warnings[lr.ID] = strings.Join(msgs, "；")
+		}
+	}
+
+	renderTemplate(w, "admin_leave.html", map[string]interface{}{
+		"CurrentUser": sess,
+		"Pending":     pending,
+		"Warnings":    warnings,
+		"Decided":     decided,
+		"Error":       errMsg,
+		"Success":     successMsg,
+	})
+}
+
+// 批准或驳回申请，批准后日期范围写为休息
+func handleLeaveDecide(w http.ResponseWriter, r *http.Request) {
+	sess := getSession(r)
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		renderLeaveQueue(w, r, "参数错误", "")
+		return
+	}
+	lr, err := getLeaveRequestByID(id)
+	if err != nil || lr.Status != LeavePending {
+		renderLeaveQueue(w, r, "申请不存在或已处理", "")
+		return
+	}
+
+	approve := r.FormValue("action") == "approve"
+	comment := strings.TrimSpace(r.FormValue("comment"))
+	if err := decideLeaveRequest(id, approve, sess.UserID, comment); err != nil {
+		renderLeaveQueue(w, r, "审批失败："+err.Error(), "")
+		return
+	}
+
+	if approve {
+		renderLeaveQueue(w, r, "", fmt.Sprintf("已批准 %s 的请假（%s ~ %s）", lr.UserName, lr.StartDate, lr.EndDate))
+	} else {
+		renderLeaveQueue(w, r, "", fmt.Sprintf("已驳回 %s 的请假（%s ~ %s）", lr.UserName, lr.StartDate, lr.EndDate))
+	}
+}
+
+// ========== 值班轮换 ==========
+
+// 值班页显示的天数
+const RotationViewDays = 60
+
+// 值班安排和换班申请
+func handleRotationsPage(w http.ResponseWriter, r *http.Request) {
+	renderRotationsPage(w, r, "")
+}
+
+func renderRotationsPage(w http.ResponseWriter, r *http.Request, errMsg string) {
+	sess := getSession(r)
+	today := userToday(r)
+	shifts, _ := getRotationShifts(today, today.AddDate(0, 0, RotationViewDays-1))
+	swaps, _ := getUserRotationSwaps(sess.UserID)
+
+	var mine, others []RotationShift
+	for _, s := range shifts {
+		if s.UserID == sess.UserID {
+			mine = append(mine, s)
+		} else {
+			others = append(others, s)
+		}
+	}
+
+	renderTemplate(w, "rotations.html", map[string]interface{}{
+		"CurrentUser": sess,
+		"Shifts":      shifts,
+		"MyShifts":    mine,
+		"OtherShifts": others,
+		"Swaps":       swaps,
+		"Days":        RotationViewDays,
+		"Error":       errMsg,
+		"Prefs":       getCalendarPrefs(sess.UserID),
+	})
+}
+
+// parseShiftKey 解析 "轮换ID:日期" 格式的班次
+func parseShiftKey(key string) (int, string, error) {
+	parts := strings.SplitN(key, ":", 2)
+	if len(parts) != 2 {
+		return 0, "", fmt.Errorf("请选择班次")
+	}
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, "", fmt.Errorf("请选择班次")
+	}
+	if _, err := time.Parse("2006-01-02", parts[1]); err != nil {
+		return 0, "", fmt.Errorf("日期格式错误")
+	}
+	return id, parts[1], nil
+}
+
+// 发起换班：用自己的一个班次换同一轮换中别人的班次
+func handleRotationSwapRequest(w http.ResponseWriter, r *http.Request) {
+	sess := getSession(r)
+	rotationID, myDate, err := parseShiftKey(r.FormValue("my_shift"))
+	if err != nil {
+		renderRotationsPage(w, r, err.Error())
+		return
+	}
+	targetRotation, targetDate, err := parseShiftKey(r.FormValue("target_shift"))
+	if err != nil {
+		renderRotationsPage(w, r, err.Error())
+		return
+	}
+	if targetRotation != rotationID {
+		renderRotationsPage(w, r, "只能和同一轮换中的班次交换")
+		return
+	}
+	if today := userToday(r).Format("2006-01-02"); myDate < today || targetDate < today {
+		renderRotationsPage(w, r, "不能交换已经过去的班次")
+		return
+	}
+
+	if owner, err := getRotationShiftUser(rotationID, myDate); err != nil || owner != sess.UserID {
+		renderRotationsPage(w, r, "这不是你的班次")
+		return
+	}
+	targetID, err := getRotationShiftUser(rotationID, targetDate)
+	if err != nil || targetID == sess.UserID {
+		renderRotationsPage(w, r, "请选择其他人的班次")
+		return
+	}
+
+	err = createRotationSwap(RotationSwap{
+		RotationID:    rotationID,
+		RequesterID:   sess.UserID,
+		RequesterDate: myDate,
+		TargetID:      targetID,
+		TargetDate:    targetDate,
+	})
+	if err != nil {
+		renderRotationsPage(w, r, "提交失败")
+		return
+	}
+	http.Redirect(w, r, "/rotations", http.StatusFound)
+}
+
+// checkRotationSwap 接受换班前的检查，与直接修改日程的规则一致：
+// 不能改写过去的日期、已批准的请假和显式设置的休息，在岗人数规则按 /schedule 同样处理。
+// 返回只需提醒的在岗人数不足信息
+func checkRotationSwap(sess *Session, sw *RotationSwap, today time.Time) (string, error) {
+	todayStr := today.Format("2006-01-02")
+	if sw.RequesterDate < todayStr || sw.TargetDate < todayStr {
+		return "", fmt.Errorf("不能交换已经过去的班次")
+	}
+
+	changes := sw.ScheduleChanges()
+	var warnings []string
+	for _, userID := range []int{sw.RequesterID, sw.TargetID} {
+		name := "对方"
+		if u, err := getUserByID(userID); err == nil {
+			name = u.DisplayName
+		}
+		halves := make(map[string][2]int)
+		for date, status := range changes[userID] {
+			if needsLeaveApproval(sess, status) {
+				return "", fmt.Errorf("换班会把 %s 在 %s 设为休息，请走请假申请", name, date)
+			}
+			if hasApprovedLeave(userID, date) {
+				return "", fmt.Errorf("%s 在 %s 已请假，不能换班", name, date)
+			}
+			current := getDaySchedule(userID, date)
+			am, pm := current.Halves()
+			if current.Source == SourceExplicit && (isOffStatus(am) || isOffStatus(pm)) {
+				return "", fmt.Errorf("%s 在 %s 已设为%s，不能换班", name, date, dayStatusName(current.Status, current.PMStatus))
+			}
+			if status == StatusUnset {
+				inherited, err := getInheritedSchedule(userID, date)
+				if err != nil {
+					return "", err
+				}
+				am, pm := inherited.Halves()
+				halves[date] = [2]int{am, pm}
+				continue
+			}
+			halves[date] = [2]int{status, status}
+		}
+		msg, rejected := coverageWarning(sess, userID, halves)
+		if rejected {
+			return "", fmt.Errorf("%s", msg)
+		}
+		if msg != "" {
+			warnings = append(warnings, msg)
+		}
+	}
+	return strings.Join(warnings, "；"), nil
+}
+
+// 接受或拒绝换班申请
+func handleRotationSwapDecide(w http.ResponseWriter, r *http.Request) {
+	sess := getSession(r)
+	id, _ := strconv.Atoi(r.FormValue("id"))
+	accept := r.FormValue("action") == "accept"
+
+	var warning string
+	if accept {
+		sw, err := getPendingRotationSwap(id, sess.UserID)
+		if err != nil {
+			renderRotationsPage(w, r, "换班申请不存在或已处理")
+			return
+		}
+		if warning, err = checkRotationSwap(sess, sw, userToday(r)); err != nil {
+			renderRotationsPage(w, r, err.Error())
+			return
+		}
+	}
+
+	if err := decideRotationSwap(id, sess.UserID, accept); err != nil {
+		renderRotationsPage(w, r, err.Error())
+		return
+	}
+	if warning != "" {
+		renderRotationsPage(w, r, "已接受换班。"+warning)
+		return
+	}
+	http.Redirect(w, r, "/rotations", http.StatusFound)
+}
+
+// 撤回换班申请
+func handleRotationSwapCancel(w http.ResponseWriter, r *http.Request) {
+	sess := getSession(r)
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err == nil {
+		cancelRotationSwap(id, sess.UserID)
+	}
+	http.Redirect(w, r, "/rotations", http.StatusFound)
+}
+
+// 轮换管理页
+func handleRotationsAdmin(w http.ResponseWriter, r *http.Request) {
+	renderRotationsAdmin(w, r, "", "")
+}
+
+func renderRotationsAdmin(w http.ResponseWriter, r *http.Request, errMsg, successMsg string) {
+	rotations, _ := getRotations()
+	users, _ := getAllUsers()
+	renderTemplate(w, "admin_rotations.html", map[string]interface{}{
+		"CurrentUser": getSession(r),
+		"Rotations":   rotations,
+		"Users":       users,
+		"Today":       userNow(r).Format("2006-01-02"),
+		"MaxMonths":   MaxRotationMonths,
+		"Error":       errMsg,
+		"Success":     successMsg,
+	})
+}
+
+// 创建轮换，成员顺序由 order_{用户ID} 决定，留空表示不参加
+func handleRotationCreate(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		renderRotationsAdmin(w, r, "请填写轮换名称", "")
+		return
+	}
+	shiftDays, err := strconv.Atoi(r.FormValue("shift_days"))
+	if err != nil || shiftDays < 1 {
+		renderRotationsAdmin(w, r, "每班天数至少为 1", "")
+		return
+	}
+	startDate := r.FormValue("start_date")
+	if _, err := time.Parse("2006-01-02", startDate); err != nil {
+		renderRotationsAdmin(w, r, "开始日期格式错误", "")
+		return
+	}
+
+	users, _ := getAllUsers()
+	var members []RotationMember
+	for _, u := range users {
+		v := strings.TrimSpace(r.FormValue(fmt.Sprintf("order_%d", u.ID)))
+		if v == "" {
+			continue
+		}
+		pos, err := strconv.Atoi(v)
+		if err != nil {
+			renderRotationsAdmin(w, r, "顺序必须是数字", "")
+			return
+		}
+		members = append(members, RotationMember{UserID: u.ID, DisplayName: u.DisplayName, Position: pos})
+	}
+	if len(members) == 0 {
+		renderRotationsAdmin(w, r, "请至少为一位成员填写顺序", "")
+		return
+	}
+
+	err = createRotation(Rotation{
+		Name:         name,
+		ShiftDays:    shiftDays,
+		StartDate:    startDate,
+		SkipHolidays: r.FormValue("skip_holidays") == "on",
+		Members:      members,
+	})
+	if err != nil {
+		renderRotationsAdmin(w, r, "保存失败", "")
+		return
+	}
+	http.Redirect(w, r, "/admin/rotations", http.StatusFound)
+}
+
+// 生成今天（或开始日期）起若干个月的排班并写入 🐮🐴
+func handleRotationGenerate(w http.ResponseWriter, r *http.Request) {
+	sess := getSession(r)
+	id, _ := strconv.Atoi(r.FormValue("id"))
+	rt, err := getRotationByID(id)
+	if err != nil {
+		renderRotationsAdmin(w, r, "轮换不存在", "")
+		return
+	}
+	months, _ := strconv.Atoi(r.FormValue("months"))
+	if months < 1 || months > MaxRotationMonths {
+		renderRotationsAdmin(w, r, fmt.Sprintf("生成月数应在 1 ~ %d 之间", MaxRotationMonths), "")
+		return
+	}
+
+	from := userToday(r)
+	if start, _ := time.Parse("2006-01-02", rt.StartDate); start.After(from) {
+		from = start
+	}
+	to := from.AddDate(0, months, -1)
+
+	start, _ := time.Parse("2006-01-02", rt.StartDate)
+	holidays, _ := getHolidays(start, to)
+	assign, err := assignRotation(*rt, from, to, holidays)
+	if err != nil {
+		renderRotationsAdmin(w, r, err.Error(), "")
+		return
+	}
+
+	written, conflicts, err := saveRotationShifts(rt.ID, from, assign, sess.UserID)
+	if err != nil {
+		renderRotationsAdmin(w, r, "生成失败："+err.Error(), "")
+		return
+	}
+	msg := fmt.Sprintf("已生成「%s」%s ~ %s 的排班，共 %d 天，写入 %d 天", rt.Name,
+		from.Format("2006-01-02"), to.Format("2006-01-02"), len(assign), written)
+	if conflicts > 0 {
+		msg += fmt.Sprintf("；%d 天值班人已请假或休息，未覆盖，请安排换班", conflicts)
+	}
+	renderRotationsAdmin(w, r, "", msg)
+}
+
+// 删除轮换
+func handleRotationDelete(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err == nil {
+		deleteRotation(id)
+	}
+	http.Redirect(w, r, "/admin/rotations", http.StatusFound)
+}
+
+// ========== 个人设置 / 日历订阅 ==========
+
+// 个人设置页
+func handleSettingsPage(w http.ResponseWriter, r *http.Request) {
+	renderSettingsPage(w, r, "")
+}
+
+func renderSettingsPage(w http.ResponseWriter, r *http.Request, errMsg string) {
+	sess := getSession(r)
+
+	data := map[string]interface{}{
+		"CurrentUser":   sess,
+		"Prefs":         getCalendarPrefs(sess.UserID),
+		"Weekdays":      weekdayNames,
+		"MaxLabelRunes": MaxWeekdayLabelLength,
+		"Timezone":      getUserTimezone(sess.UserID),
+		"DefaultTZ":     defaultLocation.String(),
+		"Timezones":     commonTimezones,
+		"Now":           userNow(r).Format("2006-01-02 15:04"),
+		"Error":         errMsg,
+	}
+	if token := getFeedToken(sess.UserID); token != "" {
+		base := requestBaseURL(r)
+		data["PersonalFeed"] = fmt.Sprintf("%s/calendar/%s.ics?token=%s", base, url.PathEscape(sess.Username), token)
+		data["TeamFeed"] = fmt.Sprintf("%s/calendar/team.ics?token=%s", base, token)
+	}
+	renderTemplate(w, "settings.html", data)
+}
+
+// 保存个人时区，留空使用服务器默认时区
+func handleTimezoneSave(w http.ResponseWriter, r *http.Request) {
+	sess := getSession(r)
+	tz := strings.TrimSpace(r.FormValue("timezone"))
+	if tz != "" {
+		if _, err := time.LoadLocation(tz); err != nil {
+			renderSettingsPage(w, r, "未知时区: "+tz)
+			return
+		}
+	}
+	if err := setUserTimezone(sess.UserID, tz); err != nil {
+		renderSettingsPage(w, r, "保存失败")
+		return
+	}
+	http.Redirect(w, r, "/settings", http.StatusFound)
+}
+
+// 星期标签的最大长度（字符数）
+const MaxWeekdayLabelLength = 8
+
+// 保存日历显示设置
+func handleCalendarPrefsSave(w http.ResponseWriter, r *http.Request) {
+	sess := getSession(r)
+
+	weekStart, err := strconv.Atoi(r.FormValue("week_start"))
+	if err != nil || (weekStart != int(time.Sunday) && weekStart != int(time.Monday)) {
+		renderSettingsPage(w, r, "每周第一天只能是周日或周一")
+		return
+	}
+	highlight, err := strconv.Atoi(r.FormValue("highlight_weekday"))
+	if err != nil || highlight < -1 || highlight > 6 {
+		renderSettingsPage(w, r, "高亮的星期无效")
+		return
+	}
+
+	prefs := CalendarPrefs{WeekStart: time.Weekday(weekStart), HighlightWeekday: highlight}
+	for i := range prefs.WeekdayLabels {
+		label := strings.TrimSpace(r.FormValue(fmt.Sprintf("label_%d", i)))
+		if utf8.RuneCountInString(label) > MaxWeekdayLabelLength || strings.Contains(label, ",") {
+			renderSettingsPage(w, r, fmt.Sprintf("星期标签最多 %d 个字，且不能包含逗号", MaxWeekdayLabelLength))
+			return
+		}
+		if label == "" {
+			label = weekdayNames[i]
+		}
+		prefs.WeekdayLabels[i] = label
+	}
+
+	if err := setCalendarPrefs(sess.UserID, prefs); err != nil {
+		renderSettingsPage(w, r, "保存失败")
+		return
+	}
+	http.Redirect(w, r, "/settings", http.StatusFound)
+}
+
+// requestBaseURL 根据请求推断站点地址（兼容反向代理）
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// 生成或重置日历订阅 token
+func handleFeedTokenReset(w http.ResponseWriter, r *http.Request) {
+	sess := getSession(r)
+	resetFeedToken(sess.UserID, generateSessionID())
+	http.Redirect(w, r, "/settings", http.StatusFound)
+}
+
+// 撤销日历订阅 token
+func handleFeedTokenRevoke(w http.ResponseWriter, r *http.Request) {
+	sess := getSession(r)
+	revokeFeedToken(sess.UserID)
+	http.Redirect(w, r, "/settings", http.StatusFound)
+}
+
+// 日历订阅：/calendar/{username}.ics 或 /calendar/team.ics
+// 日历客户端无法登录，使用 URL 中的订阅 token 鉴权
+func handleCalendarFeed(w http.ResponseWriter, r *http.Request) {
+	if _, err := getUserIDByFeedToken(r.URL.Query().Get("token")); err != nil {
+		http.Error(w, "订阅链接无效或已撤销", http.StatusUnauthorized)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/calendar/")
+	if !strings.HasSuffix(name, ".ics") {
+		http.NotFound(w, r)
+		return
+	}
+	name = strings.TrimSuffix(name, ".ics")
+
+	var users []User
+	calName := "GSCoWork 团队日程"
+	if name == "team" {
+		users, _ = getAllUsers()
+	} else {
+		u, err := getUserByUsername(name)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		users = []User{*u}
+		calName = "GSCoWork - " + u.DisplayName
+	}
+
+	var events []icsAllDayEvent
+	for _, u := range users {
+		schedules, _ := getMarkedSchedules(u.ID)
+		for _, s := range schedules {
+			events = append(events, icsAllDayEvent{
+				UID:     fmt.Sprintf("schedule-%d-%s@gscowork", u.ID, s.Date),
+				Date:    s.Date,
+				Summary: u.DisplayName + "：" + dayStatusName(s.Status, s.PMStatus),
+			})
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", name+".ics"))
+	writeICS(w, calName, events)
+}
+
+// 后台管理页
+func handleAdminPage(w http.ResponseWriter, r *http.Request) {
+	renderAdminPage(w, r, "")
+}
+
+func renderAdminPage(w http.ResponseWriter, r *http.Request, errMsg string) {
+	renderAdminPageMsg(w, r, errMsg, "")
+}
+
+func renderAdminPageMsg(w http.ResponseWriter, r *http.Request, errMsg, successMsg string) {
+	users, _ := getAllUsers()
+	year := userNow(r).Year()
+	balances := make(map[int]LeaveBalance)
+	for _, u := range users {
+		balances[u.ID] = getLeaveBalance(u.ID, year)
+	}
+	// 节假日只列出今年及以后的
+	holidays, _ := getHolidaysFrom(fmt.Sprintf("%04d-01-01", year))
+	groups, _ := getGroups()
+	coverageRules, _ := getCoverageRules()
+	sess := getSession(r)
+	renderTemplate(w, "admin.html", map[string]interface{}{
+		"Users":         users,
+		"Groups":        groups,
+		"CoverageRules": coverageRules,
+		"Weekdays":      getCalendarPrefs(sess.UserID).DayNames(),
+		"Balances":      balances,
+		"Year":          year,
+		"Statuses":      allStatuses(),
+		"Holidays":      holidays,
+		"CurrentUser":   sess,
+		"Error":         errMsg,
+		"Success":       successMsg,
+	})
+}
+
+// 创建用户
+func handleCreateUser(w http.ResponseWriter, r *http.Request) {
+	username := r.FormValue("username")
+	password := r.FormValue("password")
+	displayName := r.FormValue("display_name")
+	isAdmin := r.FormValue("is_admin") == "on"
+	isLead := r.FormValue("is_lead") == "on"
+
+	if username == "" || password == "" || displayName == "" {
+		renderAdminPage(w, r, "所有字段必填")
+		return
+	}
+
+	err := createUser(username, password, displayName, isAdmin, isLead)
+	if err != nil {
+		renderAdminPage(w, r, "创建失败：用户名可能已存在")
+		return
+	}
+
+	http.Redirect(w, r, "/admin", http.StatusFound)
+}
+
+// 编辑用户页面
+func handleEditUserPage(w http.ResponseWriter, r *http.Request) {
+	idStr := r.URL.Query().Get("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Redirect(w, r, "/admin", http.StatusFound)
+		return
+	}
+
+	user, err := getUserByID(id)
+	if err != nil {
+		http.Redirect(w, r, "/admin", http.StatusFound)
+		return
+	}
+
+	renderEditUserPage(w, r, user, "")
+}
+
+func renderEditUserPage(w http.ResponseWriter, r *http.Request, user *User, errMsg string) {
+	year := userNow(r).Year()
+	renderTemplate(w, "admin_edit.html", map[string]interface{}{
+		"User":        user,
+		"Year":        year,
+		"Balance":     getLeaveBalance(user.ID, year),
+		"CurrentUser": getSession(r),
+		"Error":       errMsg,
+	})
+}
+
+// 更新用户
+func handleUpdateUser(w http.ResponseWriter, r *http.Request) {
+	idStr := r.FormValue("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Redirect(w, r, "/admin", http.StatusFound)
+		return
+	}
+
+	displayName := r.FormValue("display_name")
+	password := r.FormValue("password") // 可选，留空不修改
+	isAdmin := r.FormValue("is_admin") == "on"
+	isLead := r.FormValue("is_lead") == "on"
+
+	user, err := getUserByID(id)
+	if err != nil {
+		http.Redirect(w, r, "/admin", http.StatusFound)
+		return
+	}
+
+	if displayName == "" {
+		renderEditUserPage(w, r, user, "显示名称不能为空")
+		return
+	}
+
+	// 年假额度，留空表示不设额度
+	quotaYear, err := strconv.Atoi(r.FormValue("quota_year"))
+	if err != nil {
+		quotaYear = userNow(r).Year()
+	}
+	quota := -1.0
+	if q := strings.TrimSpace(r.FormValue("leave_quota")); q != "" {
+		quota, err = strconv.ParseFloat(q, 64)
+		if err != nil || quota < 0 {
+			renderEditUserPage(w, r, user, "年假额度格式错误")
+			return
+		}
+	}
+
+	err = updateUser(id, displayName, password, isAdmin, isLead)
+	if err == nil {
+		err = setLeaveQuota(id, quotaYear, quota)
+	}
+	if err != nil {
+		renderEditUserPage(w, r, user, "更新失败")
+		return
+	}
+
+	http.Redirect(w, r, "/admin", http.StatusFound)
+}
+
+// 删除用户
+func handleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	sess := getSession(r)
+	idStr := r.FormValue("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Redirect(w, r, "/admin", http.StatusFound)
+		return
+	}
+
+	// 防止删除自己
+	if id == sess.UserID {
+		renderAdminPage(w, r, "不能删除自己")
+		return
+	}
+
+	err = deleteUser(id, userNow(r).Format("2006-01-02"))
+	if err != nil {
+		renderAdminPage(w, r, "删除失败")
+		return
+	}
+
+	http.Redirect(w, r, "/admin", http.StatusFound)
+}
+
+// ========== 日程状态管理 ==========
+
+var statusColorRe = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// 创建日程状态
+func handleCreateStatus(w http.ResponseWriter, r *http.Request) {
+	label := strings.TrimSpace(r.FormValue("label"))
+	emoji := strings.TrimSpace(r.FormValue("emoji"))
+	color := r.FormValue("color")
+	sortOrder, _ := strconv.Atoi(r.FormValue("sort_order"))
+	isOff := r.FormValue("is_off") == "on"
+
+	if label == "" || !statusColorRe.MatchString(color) {
+		renderAdminPage(w, r, "状态名称必填，颜色格式为 #RRGGBB")
+		return
 	}
 
-	data := HomeData{
-		CurrentUser: sess,
-		Calendars:   calendars,
-		Year:        year,
-		Month:       month,
-		MonthName:   fmt.Sprintf("%d年%d月", year, month),
-		PrevMonth:   fmt.Sprintf("%04d-%02d", prev.Year(), int(prev.Month())),
-		NextMonth:   fmt.Sprintf("%04d-%02d", next.Year(), int(next.Month())),
+	if err := createScheduleStatus(label, emoji, color, sortOrder, isOff); err != nil {
+		renderAdminPage(w, r, "创建状态失败")
+		return
 	}
-	renderTemplate(w, "home.html", data)
+	loadStatusCatalog()
+
+	http.Redirect(w, r, "/admin", http.StatusFound)
 }
 
 // 更新日程状态
-func handleScheduleUpdate(w http.ResponseWriter, r *http.Request) {
-	sess := getSession(r)
-	date := r.FormValue("date")
-	userID, _ := strconv.Atoi(r.FormValue("user_id"))
+func handleUpdateStatus(w http.ResponseWriter, r *http.Request) {
+	code, err := strconv.Atoi(r.FormValue("code"))
+	if err != nil {
+		http.Redirect(w, r, "/admin", http.StatusFound)
+		return
+	}
 
-	if userID != sess.UserID {
-		http.Error(w, "无权操作", http.StatusForbidden)
+	label := strings.TrimSpace(r.FormValue("label"))
+	emoji := strings.TrimSpace(r.FormValue("emoji"))
+	color := r.FormValue("color")
+	sortOrder, _ := strconv.Atoi(r.FormValue("sort_order"))
+	active := r.FormValue("active") == "on"
+	isOff := r.FormValue("is_off") == "on"
+
+	if label == "" || !statusColorRe.MatchString(color) {
+		renderAdminPage(w, r, "状态名称必填，颜色格式为 #RRGGBB")
 		return
 	}
 
-	// 循环切换状态
-	current := getScheduleStatus(userID, date)
-	next := current + 1
-	if next > StatusFire {
-		next = StatusDefault
+	// 默认状态是未标记日期的兜底，不能停用
+	if code == StatusDefault {
+		active = true
 	}
 
-	setSchedule(userID, date, next)
+	if err := updateScheduleStatus(code, label, emoji, color, sortOrder, active, isOff); err != nil {
+		renderAdminPage(w, r, "更新状态失败")
+		return
+	}
+	loadStatusCatalog()
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"status": next,
-	})
+	http.Redirect(w, r, "/admin", http.StatusFound)
 }
 
-// 后台管理页
-func handleAdminPage(w http.ResponseWriter, r *http.Request) {
-	users, _ := getAllUsers()
-	renderTemplate(w, "admin.html", map[string]interface{}{
-		"Users":       users,
-		"CurrentUser": getSession(r),
-	})
-}
+// ========== 分组管理 ==========
 
-// 创建用户
-func handleCreateUser(w http.ResponseWriter, r *http.Request) {
-	username := r.FormValue("username")
-	password := r.FormValue("password")
-	displayName := r.FormValue("display_name")
-	isAdmin := r.FormValue("is_admin") == "on"
+var groupSlugRe = regexp.MustCompile(`^[a-z0-9_-]+$`)
 
-	if username == "" || password == "" || displayName == "" {
-		users, _ := getAllUsers()
-		renderTemplate(w, "admin.html", map[string]interface{}{
-			"Users":       users,
-			"CurrentUser": getSession(r),
-			"Error":       "所有字段必填",
-		})
+// 创建分组
+func handleCreateGroup(w http.ResponseWriter, r *http.Request) {
+	slug := strings.ToLower(strings.TrimSpace(r.FormValue("slug")))
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" || !groupSlugRe.MatchString(slug) || slug == "all" {
+		renderAdminPage(w, r, "分组名称必填，标识只能包含小写字母、数字、- 和 _，且不能为 all")
 		return
 	}
-
-	err := createUser(username, password, displayName, isAdmin)
-	if err != nil {
-		users, _ := getAllUsers()
-		renderTemplate(w, "admin.html", map[string]interface{}{
-			"Users":       users,
-			"CurrentUser": getSession(r),
-			"Error":       "创建失败：用户名可能已存在",
-		})
+	if err := createGroup(slug, name); err != nil {
+		renderAdminPage(w, r, "创建分组失败，标识可能已存在")
 		return
 	}
-
 	http.Redirect(w, r, "/admin", http.StatusFound)
 }
 
-// 编辑用户页面
-func handleEditUserPage(w http.ResponseWriter, r *http.Request) {
-	idStr := r.URL.Query().Get("id")
-	id, err := strconv.Atoi(idStr)
+// 设置分组成员
+func handleGroupMembers(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.FormValue("id"))
 	if err != nil {
 		http.Redirect(w, r, "/admin", http.StatusFound)
 		return
 	}
-
-	user, err := getUserByID(id)
-	if err != nil {
-		http.Redirect(w, r, "/admin", http.StatusFound)
+	r.ParseForm()
+	var userIDs []int
+	for _, v := range r.Form["user_id"] {
+		if uid, err := strconv.Atoi(v); err == nil {
+			userIDs = append(userIDs, uid)
+		}
+	}
+	if err := setGroupMembers(id, userIDs); err != nil {
+		renderAdminPage(w, r, "保存分组成员失败")
 		return
 	}
-
-	renderTemplate(w, "admin_edit.html", map[string]interface{}{
-		"User":        user,
-		"CurrentUser": getSession(r),
-	})
+	http.Redirect(w, r, "/admin", http.StatusFound)
 }
 
-// 更新用户
-func handleUpdateUser(w http.ResponseWriter, r *http.Request) {
-	idStr := r.FormValue("id")
-	id, err := strconv.Atoi(idStr)
+// 删除分组
+func handleDeleteGroup(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.FormValue("id"))
 	if err != nil {
 		http.Redirect(w, r, "/admin", http.StatusFound)
 		return
 	}
+	if err := deleteGroup(id); err != nil {
+		renderAdminPage(w, r, "删除分组失败")
+		return
+	}
+	http.Redirect(w, r, "/admin", http.StatusFound)
+}
 
-	displayName := r.FormValue("display_name")
-	password := r.FormValue("password") // 可选，留空不修改
-	isAdmin := r.FormValue("is_admin") == "on"
+// ========== 在岗人数规则 ==========
 
-	if displayName == "" {
-		user, _ := getUserByID(id)
-		renderTemplate(w, "admin_edit.html", map[string]interface{}{
-			"User":        user,
-			"CurrentUser": getSession(r),
-			"Error":       "显示名称不能为空",
-		})
+// 保存在岗人数规则，可一次勾选多个星期
+func handleCoverageRuleSave(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	groupID, _ := strconv.Atoi(r.FormValue("group_id"))
+	minCount, err := strconv.Atoi(r.FormValue("min_count"))
+	if err != nil || minCount < 1 {
+		renderAdminPage(w, r, "最少在岗人数至少为 1")
 		return
 	}
-
-	err = updateUser(id, displayName, password, isAdmin)
-	if err != nil {
-		user, _ := getUserByID(id)
-		renderTemplate(w, "admin_edit.html", map[string]interface{}{
-			"User":        user,
-			"CurrentUser": getSession(r),
-			"Error":       "更新失败",
-		})
+	if groupID != 0 {
+		if _, err := getGroupByID(groupID); err != nil {
+			renderAdminPage(w, r, "分组不存在")
+			return
+		}
+	}
+	var weekdays []int
+	for _, v := range r.Form["weekday"] {
+		if d, err := strconv.Atoi(v); err == nil && d >= 0 && d <= 6 {
+			weekdays = append(weekdays, d)
+		}
+	}
+	if len(weekdays) == 0 {
+		renderAdminPage(w, r, "请至少选择一个星期")
 		return
 	}
 
+	enforce := r.FormValue("enforce") == "on"
+	for _, d := range weekdays {
+		if err := setCoverageRule(groupID, d, minCount, enforce); err != nil {
+			renderAdminPage(w, r, "保存规则失败")
+			return
+		}
+	}
 	http.Redirect(w, r, "/admin", http.StatusFound)
 }
 
-// 删除用户
-func handleDeleteUser(w http.ResponseWriter, r *http.Request) {
-	sess := getSession(r)
-	idStr := r.FormValue("id")
-	id, err := strconv.Atoi(idStr)
+// 删除在岗人数规则
+func handleCoverageRuleDelete(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.FormValue("id"))
 	if err != nil {
 		http.Redirect(w, r, "/admin", http.StatusFound)
 		return
 	}
+	if err := deleteCoverageRule(id); err != nil {
+		renderAdminPage(w, r, "删除规则失败")
+		return
+	}
+	http.Redirect(w, r, "/admin", http.StatusFound)
+}
 
-	// 防止删除自己
-	if id == sess.UserID {
-		users, _ := getAllUsers()
-		renderTemplate(w, "admin.html", map[string]interface{}{
-			"Users":       users,
-			"CurrentUser": sess,
-			"Error":       "不能删除自己",
-		})
+// ========== 节假日管理 ==========
+
+// 导入节假日文件（JSON / CSV / ICS）
+func handleHolidayImport(w http.ResponseWriter, r *http.Request) {
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		renderAdminPage(w, r, "请选择要导入的文件")
 		return
 	}
+	defer file.Close()
 
-	err = deleteUser(id)
+	data, err := io.ReadAll(io.LimitReader(file, 2<<20))
 	if err != nil {
-		users, _ := getAllUsers()
-		renderTemplate(w, "admin.html", map[string]interface{}{
-			"Users":       users,
-			"CurrentUser": sess,
-			"Error":       "删除失败",
-		})
+		renderAdminPage(w, r, "读取文件失败")
+		return
+	}
+
+	holidays, err := parseHolidayFile(header.Filename, data)
+	if err != nil {
+		renderAdminPage(w, r, "导入失败："+err.Error())
+		return
+	}
+	if len(holidays) == 0 {
+		renderAdminPage(w, r, "文件中没有节假日数据")
+		return
+	}
+
+	if err := saveHolidays(holidays); err != nil {
+		renderAdminPage(w, r, "导入失败："+err.Error())
 		return
 	}
 
+	renderAdminPageMsg(w, r, "", fmt.Sprintf("已导入 %d 天节假日数据", len(holidays)))
+}
+
+// 删除节假日
+func handleHolidayDelete(w http.ResponseWriter, r *http.Request) {
+	deleteHoliday(r.FormValue("date"))
 	http.Redirect(w, r, "/admin", http.StatusFound)
 }
 
@@ -369,32 +2225,95 @@ type ExpenseUserData struct {
 	DiscountUsage float64
 	DiscountRate  float64
 	TotalUsage    float64
-	Cost          float64
+	Cost          Cents
 }
 
 type ExpensePageData struct {
 	CurrentUser    *Session
 	Users          []ExpenseUserData
 	TotalUserCount int // 包含admin在内的所有用户数（用于计算服务器费用分摊）
-	AccountFee     float64
-	ServerFee      float64
+	Params         AllocationParams
+	Strategies     []allocationStrategy
 	TotalUsage     float64
 	StartDate      string
 	EndDate        string
 	Error          string
 	Success        string
+	Groups         []Group
+	Group          *Group // 按分组计算时的分组，nil 为全部用户
+}
+
+// expenseGroup 费用计算的用户范围：带 group 参数时只包含该分组成员
+func expenseGroup(r *http.Request) (*Group, []User) {
+	var group *Group
+	groupID := 0
+	if slug := r.FormValue("group"); slug != "" {
+		if g, err := getGroupBySlug(slug); err == nil {
+			group, groupID = g, g.ID
+		}
+	}
+	users, _ := getGroupUsers(groupID)
+	return group, users
+}
+
+// parseAllocationParams 从表单解析分摊参数，分摊人数为范围内的全部用户（包含admin）
+func parseAllocationParams(r *http.Request, users []User) (AllocationParams, error) {
+	p := AllocationParams{Strategy: r.FormValue("strategy"), HeadCount: len(users)}
+	var err error
+	if p.AccountFee, err = parseCents(r.FormValue("account_fee")); err != nil {
+		return p, err
+	}
+	if p.ServerFee, err = parseCents(r.FormValue("server_fee")); err != nil {
+		return p, err
+	}
+	p.UnitQuota, _ = strconv.ParseFloat(r.FormValue("unit_quota"), 64)
+	p.AmortizeMonths, _ = strconv.Atoi(r.FormValue("amortize_months"))
+	p.TierRate, _ = strconv.ParseFloat(r.FormValue("tier_rate"), 64)
+	return p, nil
+}
+
+// parseExpenseInputs 从表单解析非admin用户的使用量
+func parseExpenseInputs(r *http.Request, users []User) map[int]UserExpenseInput {
+	inputs := make(map[int]UserExpenseInput)
+	for _, u := range users {
+		if u.IsAdmin {
+			continue
+		}
+		usage, _ := strconv.ParseFloat(r.FormValue(fmt.Sprintf("usage_%d", u.ID)), 64)
+		discountUsage, _ := strconv.ParseFloat(r.FormValue(fmt.Sprintf("discount_usage_%d", u.ID)), 64)
+		discountRate, _ := strconv.ParseFloat(r.FormValue(fmt.Sprintf("discount_rate_%d", u.ID)), 64)
+		inputs[u.ID] = UserExpenseInput{
+			Usage:         usage,
+			DiscountUsage: discountUsage,
+			DiscountRate:  discountRate,
+		}
+	}
+	return inputs
 }
 
 // 费用页面
 func handleExpensePage(w http.ResponseWriter, r *http.Request) {
 	sess := getSession(r)
-	users, _ := getAllUsers()
+	group, users := expenseGroup(r)
+	groups, _ := getGroups()
+
+	// 分摊方式沿用上一条记录，没有记录时使用默认值
+	params := defaultAllocationParams()
 
 	// 默认日期范围：根据上一个周期自动计算
 	// 例如上一个周期是1.12 - 2.12，下一个就是2.12 - 3.12
 	var startDate, endDate string
-	latestRecord, err := getLatestExpenseRecord()
+	groupID := 0
+	if group != nil {
+		groupID = group.ID
+	}
+	latestRecord, err := getLatestExpenseRecord(groupID)
 	if err == nil && latestRecord != nil {
+		params.Strategy = latestRecord.Strategy
+		params.UnitQuota = latestRecord.UnitQuota
+		params.AmortizeMonths = latestRecord.AmortizeMonths
+		params.TierRate = latestRecord.TierRate
+
 		// 有上一个周期，根据上一个周期计算
 		// 新的开始日期 = 上一个周期的结束日期
 		startDate = latestRecord.EndDate
@@ -406,14 +2325,14 @@ func handleExpensePage(w http.ResponseWriter, r *http.Request) {
 			endDate = nextEndDate.Format("2006-01-02")
 		} else {
 			// 解析失败，使用当月
-			now := time.Now()
-			endDate = time.Date(now.Year(), now.Month()+1, 0, 0, 0, 0, 0, time.Local).Format("2006-01-02")
+			now := userNow(r)
+			endDate = time.Date(now.Year(), now.Month()+1, 0, 0, 0, 0, 0, now.Location()).Format("2006-01-02")
 		}
 	} else {
 		// 没有上一个周期，默认当月
-		now := time.Now()
-		startDate = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local).Format("2006-01-02")
-		endDate = time.Date(now.Year(), now.Month()+1, 0, 0, 0, 0, 0, time.Local).Format("2006-01-02")
+		now := userNow(r)
+		startDate = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location()).Format("2006-01-02")
+		endDate = time.Date(now.Year(), now.Month()+1, 0, 0, 0, 0, 0, now.Location()).Format("2006-01-02")
 	}
 
 	// 统计所有用户数量（包含admin，用于服务器费用分摊）
@@ -442,11 +2361,13 @@ func handleExpensePage(w http.ResponseWriter, r *http.Request) {
 		CurrentUser:    sess,
 		Users:          expenseUsers,
 		TotalUserCount: totalUserCount,
-		AccountFee:     DefaultAccountFee,
-		ServerFee:      DefaultServerFee,
+		Params:         params,
+		Strategies:     allocationStrategies,
 		TotalUsage:     0,
 		StartDate:      startDate,
 		EndDate:        endDate,
+		Groups:         groups,
+		Group:          group,
 	}
 
 	renderTemplate(w, "expense.html", data)
@@ -454,65 +2375,24 @@ func handleExpensePage(w http.ResponseWriter, r *http.Request) {
 
 // 计算费用（AJAX）
 func handleExpenseCalculate(w http.ResponseWriter, r *http.Request) {
-	accountFee, _ := strconv.ParseFloat(r.FormValue("account_fee"), 64)
-	serverFee, _ := strconv.ParseFloat(r.FormValue("server_fee"), 64)
-	totalUserCount, _ := strconv.Atoi(r.FormValue("total_user_count"))
-
-	users, _ := getAllUsers()
-
-	// 确保用户数量至少为1
-	if totalUserCount == 0 {
-		totalUserCount = len(users)
-	}
-	if totalUserCount == 0 {
-		totalUserCount = 1
-	}
-
-	// 计算每个用户的服务器费用分摊部分（所有用户平均分摊，包含admin）
-	serverFeePerUser := serverFee / 12.0 / float64(totalUserCount)
-
-	var totalUsage float64
-	usages := make(map[int]float64)
-	discountUsages := make(map[int]float64)
-	discountRates := make(map[int]float64)
-
-	for _, u := range users {
-		if u.IsAdmin {
-			continue
-		}
-		usage, _ := strconv.ParseFloat(r.FormValue(fmt.Sprintf("usage_%d", u.ID)), 64)
-		discountUsage, _ := strconv.ParseFloat(r.FormValue(fmt.Sprintf("discount_usage_%d", u.ID)), 64)
-		discountRate, _ := strconv.ParseFloat(r.FormValue(fmt.Sprintf("discount_rate_%d", u.ID)), 64)
-		usages[u.ID] = usage
-		discountUsages[u.ID] = discountUsage
-		discountRates[u.ID] = discountRate
-		userTotalUsage := usage + discountUsage*discountRate
-		totalUsage += userTotalUsage
+	_, users := expenseGroup(r)
+	params, err := parseAllocationParams(r, users)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	results := make([]map[string]interface{}, 0)
-	for _, u := range users {
-		if u.IsAdmin {
-			continue
-		}
-		usage := usages[u.ID]
-		userTotalUsage := usage + discountUsages[u.ID]*discountRates[u.ID]
-
-		cost := userTotalUsage/2800.0*accountFee + serverFeePerUser
-		cost = math.Round(cost*100) / 100
-
-		results = append(results, map[string]interface{}{
-			"user_id":     u.ID,
-			"usage":       usage,
-			"total_usage": userTotalUsage,
-			"cost":        cost,
-		})
+	results, totalUsage, totalCost, err := allocateExpense(params, parseExpenseInputs(r, users))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"total_usage": totalUsage,
-		"results":     results,
+		"total_usage":      totalUsage,
+		"total_cost_cents": totalCost,
+		"results":          results,
 	})
 }
 
@@ -522,31 +2402,17 @@ func handleExpenseSave(w http.ResponseWriter, r *http.Request) {
 
 	startDate := r.FormValue("start_date")
 	endDate := r.FormValue("end_date")
-	accountFee, _ := strconv.ParseFloat(r.FormValue("account_fee"), 64)
-	serverFee, _ := strconv.ParseFloat(r.FormValue("server_fee"), 64)
-
-	users, _ := getAllUsers()
-
-	// 统计所有用户数量（包含admin，用于服务器费用分摊）
-	totalUserCount := len(users)
 
-	// 只处理非admin用户
-	userInputs := make(map[int]UserExpenseInput)
-	for _, u := range users {
-		if u.IsAdmin {
-			continue
-		}
-		usage, _ := strconv.ParseFloat(r.FormValue(fmt.Sprintf("usage_%d", u.ID)), 64)
-		discountUsage, _ := strconv.ParseFloat(r.FormValue(fmt.Sprintf("discount_usage_%d", u.ID)), 64)
-		discountRate, _ := strconv.ParseFloat(r.FormValue(fmt.Sprintf("discount_rate_%d", u.ID)), 64)
-		userInputs[u.ID] = UserExpenseInput{
-			Usage:         usage,
-			DiscountUsage: discountUsage,
-			DiscountRate:  discountRate,
+	group, users := expenseGroup(r)
+	userInputs := parseExpenseInputs(r, users)
+	params, err := parseAllocationParams(r, users)
+	if err == nil {
+		groupID := 0
+		if group != nil {
+			groupID = group.ID
 		}
+		_, err = createExpenseRecord(startDate, endDate, groupID, params, userInputs)
 	}
-
-	_, err := createExpenseRecord(startDate, endDate, accountFee, serverFee, userInputs, totalUserCount)
 	if err != nil {
 		// 重新渲染页面并显示错误
 		var expenseUsers []ExpenseUserData
@@ -569,13 +2435,15 @@ func handleExpenseSave(w http.ResponseWriter, r *http.Request) {
 		data := ExpensePageData{
 			CurrentUser:    sess,
 			Users:          expenseUsers,
-			TotalUserCount: totalUserCount,
-			AccountFee:     accountFee,
-			ServerFee:      serverFee,
+			TotalUserCount: len(users),
+			Params:         params,
+			Strategies:     allocationStrategies,
 			StartDate:      startDate,
 			EndDate:        endDate,
 			Error:          "保存失败：" + err.Error(),
+			Group:          group,
 		}
+		data.Groups, _ = getGroups()
 		renderTemplate(w, "expense.html", data)
 		return
 	}
@@ -587,10 +2455,14 @@ func handleExpenseSave(w http.ResponseWriter, r *http.Request) {
 func handleExpenseHistory(w http.ResponseWriter, r *http.Request) {
 	sess := getSession(r)
 	records, _ := getAllExpenseRecords()
+	totals, _ := getExpenseCostTotals()
+	locked, _ := getLockedExpenseRecords()
 
 	renderTemplate(w, "expense_history.html", map[string]interface{}{
 		"CurrentUser": sess,
 		"Records":     records,
+		"Reconcile":   reconcileExpenses(records, totals),
+		"Locked":      locked,
 	})
 }
 
@@ -613,20 +2485,166 @@ func handleExpenseDetail(w http.ResponseWriter, r *http.Request) {
 	usages, _ := getExpenseUsages(id)
 
 	// 计算总使用量和总费用
-	var totalUsage, totalCost float64
+	var totalUsage float64
+	var totalCost Cents
 	for _, u := range usages {
 		userTotal := u.Usage + u.DiscountUsage*u.DiscountRate
 		totalUsage += userTotal
 		totalCost += u.CalculatedCost
 	}
 
-	renderTemplate(w, "expense_detail.html", map[string]interface{}{
+	data := map[string]interface{}{
+		"CurrentUser":    sess,
+		"Record":         record,
+		"Usages":         usages,
+		"TotalUsage":     totalUsage,
+		"TotalCost":      totalCost,
+		"FormulaVersion": formulaVersionText(record.FormulaVersion),
+		"RemainderModes": remainderModes,
+	}
+	rc, err := getExpenseReconcile(id, usages)
+	if err == nil && rc != nil {
+		data["Reconcile"] = rc
+	}
+	data["InvoiceLocked"] = expenseInvoiceLocked(id)
+	data["Balances"] = expenseBalances(*record, rc, usages, userToday(r))
+	data["PayMethods"] = payMethods
+	data["Today"] = userToday(r).Format("2006-01-02")
+
+	// 用当前代码重新计算并与记录对比
+	if r.URL.Query().Get("recompute") == "1" {
+		rc, err := recomputeExpense(record, usages)
+		if err != nil {
+			data["RecomputeError"] = err.Error()
+		} else {
+			data["Recompute"] = rc
+			data["CurrentVersion"] = formulaVersionText(AllocationFormulaVersion)
+		}
+	}
+	renderTemplate(w, "expense_detail.html", data)
+}
+
+// 录入发票金额和尾差处理方式，发票金额留空表示清除
+func handleExpenseInvoice(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		http.Redirect(w, r, "/expense/history", http.StatusFound)
+		return
+	}
+
+	var invoice *Cents
+	if v := strings.TrimSpace(r.FormValue("invoice_total")); v != "" {
+		c, err := parseCents(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if c < 0 {
+			http.Error(w, "发票金额不能为负数", http.StatusBadRequest)
+			return
+		}
+		invoice = &c
+	}
+	mode := r.FormValue("remainder_mode")
+	if !validRemainderMode(mode) {
+		http.Error(w, "未知尾差处理方式", http.StatusBadRequest)
+		return
+	}
+
+	record, err := getExpenseRecordByID(id)
+	if err != nil {
+		http.Redirect(w, r, "/expense/history", http.StatusFound)
+		return
+	}
+	unchanged := record.RemainderMode == mode && record.Invoiced == (invoice != nil) &&
+		(invoice == nil || *invoice == record.InvoiceTotal)
+	if !unchanged && expenseInvoiceLocked(id) {
+		http.Error(w, "已有用户登记付款，不能再修改发票金额或尾差处理方式", http.StatusConflict)
+		return
+	}
+
+	if err := setExpenseInvoice(id, invoice, mode); err != nil {
+		http.Error(w, "保存失败", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/expense/detail?id=%d#invoice", id), http.StatusFound)
+}
+
+// 登记付款，金额为 0 表示未付款
+func handleExpensePayment(w http.ResponseWriter, r *http.Request) {
+	usageID, err := strconv.Atoi(r.FormValue("usage_id"))
+	if err != nil {
+		http.Redirect(w, r, "/expense/history", http.StatusFound)
+		return
+	}
+
+	paid, err := parseCents(r.FormValue("paid_amount"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if paid < 0 {
+		http.Error(w, "付款金额不能为负数", http.StatusBadRequest)
+		return
+	}
+	method := r.FormValue("pay_method")
+	if !validPayMethod(method) {
+		http.Error(w, "未知付款方式", http.StatusBadRequest)
+		return
+	}
+	paidDate := r.FormValue("paid_date")
+	if paid == 0 {
+		paidDate, method = "", ""
+	} else if paidDate == "" {
+		paidDate = userToday(r).Format("2006-01-02")
+	} else if _, err := time.Parse("2006-01-02", paidDate); err != nil {
+		http.Error(w, "付款日期格式错误", http.StatusBadRequest)
+		return
+	}
+
+	expenseID, err := setExpensePayment(usageID, paid, paidDate, method, strings.TrimSpace(r.FormValue("pay_note")))
+	if err != nil {
+		http.Error(w, "保存失败", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/expense/detail?id=%d#payment", expenseID), http.StatusFound)
+}
+
+// 欠款汇总：普通用户查看自己各期的付款情况，admin 查看所有人的汇总并可选择某人查看明细
+func handleExpenseBalance(w http.ResponseWriter, r *http.Request) {
+	sess := getSession(r)
+	userID := sess.UserID
+	scope := sess.UserID // 普通用户只查询自己的
+	if sess.IsAdmin {
+		userID, _ = strconv.Atoi(r.URL.Query().Get("user_id"))
+		scope = 0
+	}
+
+	balances, err := getExpenseBalances(userToday(r), scope)
+	if err != nil {
+		http.Error(w, "加载失败", http.StatusInternalServerError)
+		return
+	}
+
+	var lines []ExpenseBalance
+	for _, b := range balances {
+		if b.UserID == userID {
+			lines = append(lines, b)
+		}
+	}
+
+	data := map[string]interface{}{
 		"CurrentUser": sess,
-		"Record":      record,
-		"Usages":      usages,
-		"TotalUsage":  totalUsage,
-		"TotalCost":   math.Round(totalCost*100) / 100,
-	})
+		"Lines":       lines,
+		"DueDays":     PaymentDueDays,
+	}
+	if summaries := summarizeBalances(lines); len(summaries) > 0 {
+		data["Summary"] = summaries[0]
+	}
+	if sess.IsAdmin {
+		data["Summaries"] = summarizeBalances(balances)
+	}
+	renderTemplate(w, "expense_balance.html", data)
 }
 
 // 删除费用记录
@@ -637,8 +2655,16 @@ func handleExpenseDelete(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/expense/history", http.StatusFound)
 		return
 	}
+	// 已有付款的记录参与了之后的对账，和修改发票一样不能再删除
+	if expenseInvoiceLocked(id) {
+		http.Error(w, "已有用户登记付款，不能删除此记录", http.StatusConflict)
+		return
+	}
 
-	deleteExpenseRecord(id)
+	if err := deleteExpenseRecord(id); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
 	http.Redirect(w, r, "/expense/history", http.StatusFound)
 }
 
@@ -653,7 +2679,7 @@ func handleExpenseUserAdd(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := createUser(username, password, displayName, false)
+	err := createUser(username, password, displayName, false, false)
 	if err != nil {
 		http.Redirect(w, r, "/expense", http.StatusFound)
 		return
@@ -678,6 +2704,6 @@ func handleExpenseUserDelete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	deleteUser(id)
+	deleteUser(id, userNow(r).Format("2006-01-02"))
 	http.Redirect(w, r, "/expense", http.StatusFound)
 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// parseHolidayFile 根据文件扩展名解析节假日文件（JSON / CSV / ICS）
+//
+// JSON: [{"date": "2026-10-01", "name": "国庆节", "kind": "holiday"}, ...]
+// CSV:  date,name,kind 每行一条，表头可选
+// ICS:  全天事件，标题含“班”的视为调休上班，其余为节假日
+func parseHolidayFile(filename string, data []byte) ([]Holiday, error) {
+	var holidays []Holiday
+	var err error
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		holidays, err = parseHolidayJSON(data)
+	case ".csv":
+		holidays, err = parseHolidayCSV(data)
+	case ".ics":
+		holidays, err = parseHolidayICS(data)
+	default:
+		return nil, fmt.Errorf("不支持的文件格式，请使用 .json / .csv / .ics")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for i, h := range holidays {
+		if _, err := time.Parse("2006-01-02", h.Date); err != nil {
+			return nil, fmt.Errorf("日期格式错误: %s", h.Date)
+		}
+		kind, ok := normalizeHolidayKind(h.Kind)
+		if !ok {
+			return nil, fmt.Errorf("%s 的类型无效: %s", h.Date, h.Kind)
+		}
+		holidays[i].Kind = kind
+		holidays[i].Name = strings.TrimSpace(h.Name)
+	}
+	return holidays, nil
+}
+
+// normalizeHolidayKind 兼容常见写法，空值视为节假日
+func normalizeHolidayKind(kind string) (string, bool) {
+	switch strings.ToLower(strings.TrimSpace(kind)) {
+	case "", HolidayKindHoliday, "休", "假":
+		return HolidayKindHoliday, true
+	case HolidayKindMakeup, "makeup", "workday", "班", "补班":
+		return HolidayKindMakeup, true
+	}
+	return "", false
+}
+
+func parseHolidayJSON(data []byte) ([]Holiday, error) {
+	var items []struct {
+		Date string `json:"date"`
+		Name string `json:"name"`
+		Kind string `json:"kind"`
+	}
+	if err := json.Unmarshal(data, &items); err != nil {
+		return nil, fmt.Errorf("JSON 解析失败: %v", err)
+	}
+	var holidays []Holiday
+	for _, it := range items {
+		holidays = append(holidays, Holiday{Date: it.Date, Name: it.Name, Kind: it.Kind})
+	}
+	return holidays, nil
+}
+
+func parseHolidayCSV(data []byte) ([]Holiday, error) {
+	reader := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))))
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("CSV 解析失败: %v", err)
+	}
+
+	var holidays []Holiday
+	for i, rec := range records {
+		if len(rec) < 2 {
+			continue
+		}
+		// 跳过表头
+		if i == 0 && strings.EqualFold(strings.TrimSpace(rec[0]), "date") {
+			continue
+		}
+		h := Holiday{Date: strings.TrimSpace(rec[0]), Name: rec[1]}
+		if len(rec) > 2 {
+			h.Kind = rec[2]
+		}
+		holidays = append(holidays, h)
+	}
+	return holidays, nil
+}
+
+func parseHolidayICS(data []byte) ([]Holiday, error) {
+	events, err := parseICS(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	var holidays []Holiday
+	for _, e := range events {
+		kind := HolidayKindHoliday
+		if strings.Contains(e.Summary, "班") {
+			kind = HolidayKindMakeup
+		}
+		for _, c := range e.Categories {
+			if k, ok := normalizeHolidayKind(c); ok {
+				kind = k
+			}
+		}
+		for _, date := range e.Dates() {
+			holidays = append(holidays, Holiday{Date: date, Name: e.Summary, Kind: kind})
+		}
+	}
+	return holidays, nil
+}
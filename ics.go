@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// icsEvent iCalendar 中的一个 VEVENT（只保留用到的字段）
+type icsEvent struct {
+	Summary    string
+	Categories []string
+	Start      time.Time
+	End        time.Time // 不含，与 RFC 5545 DTEND 语义一致
+	AllDay     bool
+}
+
+// Dates 返回事件覆盖的日期（YYYY-MM-DD）
+func (e icsEvent) Dates() []string {
+	var dates []string
+	start := time.Date(e.Start.Year(), e.Start.Month(), e.Start.Day(), 0, 0, 0, 0, time.UTC)
+	end := time.Date(e.End.Year(), e.End.Month(), e.End.Day(), 0, 0, 0, 0, time.UTC)
+	// 非全天事件结束在某天中途时，这一天也算在内
+	if !e.AllDay && (e.End.Hour() != 0 || e.End.Minute() != 0 || e.End.Second() != 0) {
+		end = end.AddDate(0, 0, 1)
+	}
+	if !end.After(start) {
+		end = start.AddDate(0, 0, 1)
+	}
+	for d := start; d.Before(end); d = d.AddDate(0, 0, 1) {
+		dates = append(dates, d.Format("2006-01-02"))
+	}
+	return dates
+}
+
+// parseICS 解析 iCalendar 文件中的 VEVENT
+func parseICS(r io.Reader) ([]icsEvent, error) {
+	lines, err := unfoldICSLines(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []icsEvent
+	var cur *icsEvent
+	hasEnd := false
+	for _, line := range lines {
+		name, params, value := splitICSProperty(line)
+		switch {
+		case name == "BEGIN" && strings.EqualFold(value, "VEVENT"):
+			cur = &icsEvent{}
+			hasEnd = false
+		case name == "END" && strings.EqualFold(value, "VEVENT"):
+			if cur == nil {
+				continue
+			}
+			if cur.Start.IsZero() {
+				return nil, fmt.Errorf("事件缺少 DTSTART: %s", cur.Summary)
+			}
+			if !hasEnd {
+				if cur.AllDay {
+					cur.End = cur.Start.AddDate(0, 0, 1)
+				} else {
+					cur.End = cur.Start
+				}
+			}
+			events = append(events, *cur)
+			cur = nil
+		case cur == nil:
+			continue
+		case name == "SUMMARY":
+			cur.Summary = unescapeICSText(value)
+		case name == "CATEGORIES":
+			for _, c := range strings.Split(value, ",") {
+				if c = strings.TrimSpace(unescapeICSText(c)); c != "" {
+					cur.Categories = append(cur.Categories, c)
+				}
+			}
+		case name == "DTSTART":
+			t, allDay, err := parseICSTime(params, value)
+			if err != nil {
+				return nil, err
+			}
+			cur.Start, cur.AllDay = t, allDay
+		case name == "DTEND":
+			t, _, err := parseICSTime(params, value)
+			if err != nil {
+				return nil, err
+			}
+			cur.End = t
+			hasEnd = true
+		}
+	}
+	return events, nil
+}
+
+// unfoldICSLines 读取并合并折行（以空格或 Tab 开头的行是上一行的延续）
+func unfoldICSLines(r io.Reader) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// splitICSProperty 拆分 "NAME;PARAM=V:VALUE"
+func splitICSProperty(line string) (name string, params map[string]string, value string) {
+	params = make(map[string]string)
+	colon := strings.Index(line, ":")
+	if colon < 0 {
+		return strings.ToUpper(line), params, ""
+	}
+	head, value := line[:colon], line[colon+1:]
+	parts := strings.Split(head, ";")
+	name = strings.ToUpper(parts[0])
+	for _, p := range parts[1:] {
+		if kv := strings.SplitN(p, "=", 2); len(kv) == 2 {
+			params[strings.ToUpper(kv[0])] = strings.Trim(kv[1], `"`)
+		}
+	}
+	return name, params, value
+}
+
+// parseICSTime 解析 DATE / DATE-TIME 值，返回是否为全天
+func parseICSTime(params map[string]string, value string) (time.Time, bool, error) {
+	if params["VALUE"] == "DATE" || len(value) == 8 {
+		t, err := time.Parse("20060102", value)
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("日期格式错误: %s", value)
+		}
+		return t, true, nil
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse("20060102T150405Z", value)
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("时间格式错误: %s", value)
+		}
+		return t.In(time.Local), false, nil
+	}
+	loc := time.Local
+	if tzid := params["TZID"]; tzid != "" {
+		if l, err := time.LoadLocation(tzid); err == nil {
+			loc = l
+		}
+	}
+	t, err := time.ParseInLocation("20060102T150405", value, loc)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("时间格式错误: %s", value)
+	}
+	return t, false, nil
+}
+
+var icsTextUnescaper = strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`)
+
+func unescapeICSText(s string) string {
+	return icsTextUnescaper.Replace(s)
+}
+
+// icsAllDayEvent 导出用的全天事件
+type icsAllDayEvent struct {
+	UID     string
+	Date    string // YYYY-MM-DD
+	Summary string
+}
+
+// writeICS 输出 RFC 5545 日历，每个事件为一个全天 VEVENT
+func writeICS(w io.Writer, calName string, events []icsAllDayEvent) error {
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//GSCoWork//Schedule//ZH",
+		"CALSCALE:GREGORIAN",
+		"METHOD:PUBLISH",
+		"X-WR-CALNAME:" + escapeICSText(calName),
+	}
+	for _, e := range events {
+		d, err := time.Parse("2006-01-02", e.Date)
+		if err != nil {
+			continue
+		}
+		lines = append(lines,
+			"BEGIN:VEVENT",
+			"UID:"+e.UID,
+			"DTSTAMP:"+stamp,
+			"DTSTART;VALUE=DATE:"+d.Format("20060102"),
+			"DTEND;VALUE=DATE:"+d.AddDate(0, 0, 1).Format("20060102"),
+			"SUMMARY:"+escapeICSText(e.Summary),
+			"TRANSP:TRANSPARENT",
+			"END:VEVENT",
+		)
+	}
+	lines = append(lines, "END:VCALENDAR")
+
+	bw := bufio.NewWriter(w)
+	for _, line := range lines {
+		bw.WriteString(foldICSLine(line))
+		bw.WriteString("\r\n")
+	}
+	return bw.Flush()
+}
+
+var icsTextEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`)
+
+func escapeICSText(s string) string {
+	return icsTextEscaper.Replace(s)
+}
+
+// foldICSLine 按 RFC 5545 把超过 75 字节的行折行，不拆开 UTF-8 字符
+func foldICSLine(line string) string {
+	const limit = 75
+	if len(line) <= limit {
+		return line
+	}
+	var b strings.Builder
+	width := 0
+	for _, r := range line {
+		n := len(string(r))
+		if width+n > limit {
+			b.WriteString("\r\n ")
+			width = 1
+		}
+		b.WriteRune(r)
+		width += n
+	}
+	return b.String()
+}
+
+// icsMappingRule 导入时的映射：事件标题包含关键词或分类等于关键词时使用该状态
+type icsMappingRule struct {
+	Keyword string
+	Status  int
+}
+
+// parseICSMapping 解析 “关键词 = 状态名称或编码” 格式的映射，每行一条，# 开头为注释
+func parseICSMapping(text string) ([]icsMappingRule, error) {
+	var rules []icsMappingRule
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("第 %d 行格式应为 关键词 = 状态", i+1)
+		}
+		keyword := strings.TrimSpace(kv[0])
+		code, ok := lookupActiveStatus(strings.TrimSpace(kv[1]))
+		if keyword == "" || !ok {
+			return nil, fmt.Errorf("第 %d 行的状态无效: %s", i+1, strings.TrimSpace(kv[1]))
+		}
+		rules = append(rules, icsMappingRule{Keyword: keyword, Status: code})
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("至少需要一条映射")
+	}
+	return rules, nil
+}
+
+// matchStatus 按顺序匹配映射，第一条命中的生效
+func (e icsEvent) matchStatus(rules []icsMappingRule) (int, bool) {
+	summary := strings.ToLower(e.Summary)
+	for _, rule := range rules {
+		kw := strings.ToLower(rule.Keyword)
+		if strings.Contains(summary, kw) {
+			return rule.Status, true
+		}
+		for _, c := range e.Categories {
+			if strings.ToLower(c) == kw {
+				return rule.Status, true
+			}
+		}
+	}
+	return 0, false
+}
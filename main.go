@@ -17,12 +17,14 @@ var (
 	port    *int
 	dbPath  *string
 	pidFile *string
+	tzName  *string
 )
 
 func main() {
 	port = flag.Int("port", 8081, "监听端口")
 	dbPath = flag.String("db", "data.db", "数据库文件路径")
 	pidFile = flag.String("pid", "/var/run/gscowork.pid", "PID 文件路径")
+	tzName = flag.String("tz", "", "默认时区，如 Asia/Shanghai，为空使用服务器本地时区")
 	flag.Parse()
 
 	args := flag.Args()
@@ -64,7 +66,11 @@ func runServer() {
 		}
 	}
 
+	if err := initDefaultLocation(*tzName); err != nil {
+		log.Fatalf("时区无效: %v", err)
+	}
 	initDB(*dbPath)
+	loadStatusCatalog()
 	initTemplates()
 
 	// 启动 session 清理任务
@@ -72,6 +78,7 @@ func runServer() {
 
 	// 静态资源
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	http.HandleFunc("/status.css", handleStatusCSS)
 
 	// 路由
 	http.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
@@ -84,6 +91,31 @@ func runServer() {
 	http.HandleFunc("/logout", requireLogin(handleLogout))
 	http.HandleFunc("/", requireLogin(handleHome))
 	http.HandleFunc("/schedule", requireLogin(handleScheduleUpdate))
+	http.HandleFunc("/schedule/range", requireLogin(handleScheduleRange))
+	http.HandleFunc("/schedule/import", requireLogin(handleScheduleImport))
+	http.HandleFunc("/schedule/history", requireLogin(handleScheduleHistory))
+	http.HandleFunc("/schedule/day", requireLogin(handleScheduleDay))
+	http.HandleFunc("/schedule/note", requireLogin(handleScheduleNote))
+	http.HandleFunc("/schedule/comment", requireLogin(handleScheduleComment))
+	http.HandleFunc("/schedule/comment/delete", requireLogin(handleScheduleCommentDelete))
+	http.HandleFunc("/stats", requireLogin(handleStatsPage))
+	http.HandleFunc("/stats/json", requireLogin(handleStatsJSON))
+	http.HandleFunc("/rules", requireLogin(handleRulesPage))
+	http.HandleFunc("/rules/add", requireLogin(handleRuleAdd))
+	http.HandleFunc("/rules/delete", requireLogin(handleRuleDelete))
+	http.HandleFunc("/leave", requireLogin(handleLeavePage))
+	http.HandleFunc("/leave/request", requireLogin(handleLeaveSubmit))
+	http.HandleFunc("/leave/cancel", requireLogin(handleLeaveCancel))
+	http.HandleFunc("/rotations", requireLogin(handleRotationsPage))
+	http.HandleFunc("/rotations/swap", requireLogin(handleRotationSwapRequest))
+	http.HandleFunc("/rotations/swap/decide", requireLogin(handleRotationSwapDecide))
+	http.HandleFunc("/rotations/swap/cancel", requireLogin(handleRotationSwapCancel))
+	http.HandleFunc("/settings", requireLogin(handleSettingsPage))
+	http.HandleFunc("/settings/calendar", requireLogin(handleCalendarPrefsSave))
+	http.HandleFunc("/settings/timezone", requireLogin(handleTimezoneSave))
+	http.HandleFunc("/settings/feed/reset", requireLogin(handleFeedTokenReset))
+	http.HandleFunc("/settings/feed/revoke", requireLogin(handleFeedTokenRevoke))
+	http.HandleFunc("/calendar/", handleCalendarFeed) // 订阅 token 鉴权，不走登录
 	http.HandleFunc("/admin", requireAdmin(handleAdminPage))
 	http.HandleFunc("/admin/user", requireAdmin(handleCreateUser))
 	http.HandleFunc("/admin/user/edit", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
@@ -94,6 +126,21 @@ func runServer() {
 		}
 	}))
 	http.HandleFunc("/admin/user/delete", requireAdmin(handleDeleteUser))
+	http.HandleFunc("/admin/status", requireAdmin(handleCreateStatus))
+	http.HandleFunc("/admin/status/edit", requireAdmin(handleUpdateStatus))
+	http.HandleFunc("/admin/group", requireAdmin(handleCreateGroup))
+	http.HandleFunc("/admin/group/members", requireAdmin(handleGroupMembers))
+	http.HandleFunc("/admin/group/delete", requireAdmin(handleDeleteGroup))
+	http.HandleFunc("/admin/coverage", requireAdmin(handleCoverageRuleSave))
+	http.HandleFunc("/admin/coverage/delete", requireAdmin(handleCoverageRuleDelete))
+	http.HandleFunc("/admin/holidays/import", requireAdmin(handleHolidayImport))
+	http.HandleFunc("/admin/holidays/delete", requireAdmin(handleHolidayDelete))
+	http.HandleFunc("/admin/rotations", requireAdmin(handleRotationsAdmin))
+	http.HandleFunc("/admin/rotation/create", requireAdmin(handleRotationCreate))
+	http.HandleFunc("/admin/rotation/generate", requireAdmin(handleRotationGenerate))
+	http.HandleFunc("/admin/rotation/delete", requireAdmin(handleRotationDelete))
+	http.HandleFunc("/admin/leave", requireAdmin(handleLeaveQueue))
+	http.HandleFunc("/admin/leave/decide", requireAdmin(handleLeaveDecide))
 
 	// 费用管理路由
 	http.HandleFunc("/expense", requireLogin(handleExpensePage))
@@ -102,6 +149,9 @@ func runServer() {
 	http.HandleFunc("/expense/history", requireLogin(handleExpenseHistory))
 	http.HandleFunc("/expense/detail", requireLogin(handleExpenseDetail))
 	http.HandleFunc("/expense/delete", requireAdmin(handleExpenseDelete))
+	http.HandleFunc("/expense/invoice", requireAdmin(handleExpenseInvoice))
+	http.HandleFunc("/expense/payment", requireAdmin(handleExpensePayment))
+	http.HandleFunc("/expense/balance", requireLogin(handleExpenseBalance))
 	http.HandleFunc("/expense/user/add", requireAdmin(handleExpenseUserAdd))
 	http.HandleFunc("/expense/user/delete", requireAdmin(handleExpenseUserDelete))
 
@@ -159,6 +209,7 @@ func startDaemon() {
 		fmt.Sprintf("-port=%d", *port),
 		fmt.Sprintf("-db=%s", *dbPath),
 		fmt.Sprintf("-pid=%s", *pidFile),
+		fmt.Sprintf("-tz=%s", *tzName),
 		"run",
 	}
 
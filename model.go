@@ -8,30 +8,440 @@ type User struct {
 	Password    string
 	DisplayName string
 	IsAdmin     bool
+	IsLead      bool // 组长：可以代其他人修改日程
 	CreatedAt   time.Time
 }
 
+// CalendarPrefs 个人的日历显示设置
+type CalendarPrefs struct {
+	WeekStart        time.Weekday // 每周第一列，周日或周一
+	WeekdayLabels    [7]string    // 星期标签，下标 0 为周日
+	HighlightWeekday int          // 高亮的星期，-1 表示不高亮
+}
+
+// Offset 某个星期在日历网格中的列号
+func (p CalendarPrefs) Offset(wd time.Weekday) int {
+	return (int(wd) - int(p.WeekStart) + 7) % 7
+}
+
+// Columns 按列顺序排列的星期
+func (p CalendarPrefs) Columns() []time.Weekday {
+	cols := make([]time.Weekday, 7)
+	for i := range cols {
+		cols[i] = (p.WeekStart + time.Weekday(i)) % 7
+	}
+	return cols
+}
+
+// DayName 标题中显示的星期名称：默认的单字名称显示为 “周一”，自定义名称原样显示
+func (p CalendarPrefs) DayName(wd time.Weekday) string {
+	label := p.WeekdayLabels[wd]
+	if label == weekdayNames[wd] {
+		return "周" + label
+	}
+	return label
+}
+
+// DayNames 周日到周六的显示名称，用于星期多选和规则说明
+func (p CalendarPrefs) DayNames() []string {
+	names := make([]string, 7)
+	for i := range names {
+		names[i] = p.DayName(time.Weekday(i))
+	}
+	return names
+}
+
+// Highlighted 该星期是否高亮
+func (p CalendarPrefs) Highlighted(wd time.Weekday) bool {
+	return p.HighlightWeekday == int(wd)
+}
+
+// Group 分组（团队），用户可以属于多个分组
+type Group struct {
+	ID        int
+	Slug      string // 用于链接，如 /?group=backend
+	Name      string
+	MemberIDs map[int]bool
+	CreatedAt time.Time
+}
+
+// CoverageRule 在岗人数规则：某分组在某个星期几至少要有 MinCount 人不休息
+type CoverageRule struct {
+	ID        int
+	GroupID   int    // 0 表示全部用户
+	GroupName string // 显示用
+	Weekday   int    // 0=周日 ... 6=周六
+	MinCount  int
+	Enforce   bool // 为 true 时拒绝让人数低于下限的修改，否则只提醒
+}
+
+// CoverageShortfall 某天某条规则的人数不足
+type CoverageShortfall struct {
+	Date    string
+	Rule    CoverageRule
+	Working float64      // 在岗人数，半天休息计 0.5
+	members map[int]bool // 规则涵盖的用户，nil 表示全部
+}
+
 type Schedule struct {
-	ID     int
-	UserID int
-	Date   string // YYYY-MM-DD
-	Status int    // 1=默认 2=休息 3=🐮🐴
+	ID       int
+	UserID   int
+	Date     string // YYYY-MM-DD
+	Status   int    // 对应 schedule_statuses.code；分上下午时为上午的状态
+	PMStatus int    // 下午的状态，0 表示全天同一状态
+}
+
+// 半天：上午 / 下午，空字符串表示全天
+const (
+	HalfAM = "am"
+	HalfPM = "pm"
+)
+
+// halfName 半天的中文名称
+func halfName(half string) string {
+	switch half {
+	case HalfAM:
+		return "上午"
+	case HalfPM:
+		return "下午"
+	}
+	return ""
 }
 
+// 内置状态编码，作为 schedule_statuses 的初始数据
 const (
 	StatusDefault = 1
 	StatusRest    = 2
 	StatusFire    = 3
 )
 
+// StatusUnset 写入日程时表示清除显式设置，当天回落到节假日 / 周期规则的状态
+const StatusUnset = 0
+
+// ScheduleChange 日程变更记录
+type ScheduleChange struct {
+	ID        int
+	UserID    int
+	Date      string
+	OldStatus int    // 0 表示此前没有显式设置
+	NewStatus int    // 0 表示清除了显式设置
+	Half      string // 只修改半天时为 am / pm
+	ActorID   int
+	ActorName string
+	CreatedAt time.Time
+}
+
+// ScheduleComment 某人某天日程下的评论，ParentID 为 0 表示顶层评论
+type ScheduleComment struct {
+	ID         int
+	UserID     int // 日程所属用户
+	Date       string
+	AuthorID   int
+	AuthorName string
+	ParentID   int
+	Body       string
+	CreatedAt  time.Time
+	Replies    []*ScheduleComment
+	Deletable  bool // 当前用户可以删除（作者本人或管理员）
+}
+
+// 日程来源：显式设置 > 节假日日历 > 周期规则
+const (
+	SourceDefault  = ""
+	SourceExplicit = "explicit"
+	SourceHoliday  = "holiday"
+	SourceRule     = "rule"
+)
+
+// DaySchedule 某人某天的有效日程
+type DaySchedule struct {
+	Status   int // 全天或上午的状态
+	PMStatus int // 下午的状态，0 表示与上午相同
+	Source   string
+	EditedBy string // 由他人代为修改时为修改人显示名称
+}
+
+// Halves 返回上午和下午的状态
+func (d DaySchedule) Halves() (am, pm int) {
+	if d.PMStatus == 0 {
+		return d.Status, d.Status
+	}
+	return d.Status, d.PMStatus
+}
+
+// Split 上下午状态不同
+func (d DaySchedule) Split() bool {
+	return d.PMStatus != 0 && d.PMStatus != d.Status
+}
+
+// 节假日类型
+const (
+	HolidayKindHoliday = "holiday"        // 法定节假日
+	HolidayKindMakeup  = "makeup_workday" // 调休上班
+)
+
+// Holiday 节假日日历中的一天
+type Holiday struct {
+	Date string // YYYY-MM-DD
+	Name string
+	Kind string
+}
+
+// DefaultStatus 节假日对未设置日期的默认状态
+func (h Holiday) DefaultStatus() int {
+	if h.Kind == HolidayKindHoliday {
+		return StatusRest
+	}
+	return StatusDefault
+}
+
+// ScheduleRule 周期性日程规则，如每周六休息、大小周
+type ScheduleRule struct {
+	ID            int
+	UserID        int
+	Status        int
+	Weekdays      int    // 星期掩码：bit0=周日 ... bit6=周六
+	IntervalWeeks int    // 每 N 周生效一次，1 表示每周
+	StartDate     string // YYYY-MM-DD，同时是隔周计算的基准周
+	EndDate       string // YYYY-MM-DD，为空表示长期有效
+	CreatedAt     time.Time
+}
+
+// Matches 判断规则在某天是否生效
+func (r ScheduleRule) Matches(d time.Time) bool {
+	date := d.Format("2006-01-02")
+	if date < r.StartDate || (r.EndDate != "" && date > r.EndDate) {
+		return false
+	}
+	if r.Weekdays&(1<<int(d.Weekday())) == 0 {
+		return false
+	}
+	if r.IntervalWeeks <= 1 {
+		return true
+	}
+	// 以开始日期所在周（周一起）为第 0 周
+	start, err := time.Parse("2006-01-02", r.StartDate)
+	if err != nil {
+		return false
+	}
+	weekStart := start.AddDate(0, 0, -((int(start.Weekday()) + 6) % 7))
+	day := time.Date(d.Year(), d.Month(), d.Day(), 0, 0, 0, 0, time.UTC)
+	weeks := int(day.Sub(weekStart).Hours()/24) / 7
+	return weeks%r.IntervalWeeks == 0
+}
+
+// 请假申请状态
+const (
+	LeavePending   = "pending"
+	LeaveApproved  = "approved"
+	LeaveRejected  = "rejected"
+	LeaveCancelled = "cancelled"
+)
+
+// LeaveRequest 请假申请，审批通过后把日期范围写为休息
+type LeaveRequest struct {
+	ID           int
+	UserID       int
+	UserName     string // 申请人显示名称
+	StartDate    string // YYYY-MM-DD
+	EndDate      string // YYYY-MM-DD，含
+	Reason       string
+	Status       string
+	ApproverID   int
+	ApproverName string
+	Comment      string // 审批意见
+	CreatedAt    time.Time
+	DecidedAt    *time.Time
+}
+
+// Days 申请覆盖的天数
+func (l LeaveRequest) Days() int {
+	start, err1 := time.Parse("2006-01-02", l.StartDate)
+	end, err2 := time.Parse("2006-01-02", l.EndDate)
+	if err1 != nil || err2 != nil {
+		return 0
+	}
+	return int(end.Sub(start).Hours()/24) + 1
+}
+
+// StatusText 申请状态的中文名称
+func (l LeaveRequest) StatusText() string {
+	switch l.Status {
+	case LeavePending:
+		return "待审批"
+	case LeaveApproved:
+		return "已批准"
+	case LeaveRejected:
+		return "已驳回"
+	case LeaveCancelled:
+		return "已撤回"
+	}
+	return l.Status
+}
+
+// LeaveBalance 某人某年的年假额度和使用情况
+type LeaveBalance struct {
+	Year     int
+	HasQuota bool    // 未设置额度时不做提醒
+	Quota    float64 // 年假额度（天）
+	Used     float64 // 已标记为休息的天数（显式设置的日程）
+	Pending  float64 // 待审批请假的天数
+}
+
+// Remaining 剩余额度，不含待审批
+func (b LeaveBalance) Remaining() float64 {
+	return b.Quota - b.Used
+}
+
+// Exceeded 已用天数超出额度
+func (b LeaveBalance) Exceeded() bool {
+	return b.HasQuota && b.Used > b.Quota
+}
+
+// Over 已用连同待审批超出额度的天数，未超出为 0
+func (b LeaveBalance) Over() float64 {
+	if !b.HasQuota || b.Used+b.Pending <= b.Quota {
+		return 0
+	}
+	return b.Used + b.Pending - b.Quota
+}
+
+// Rotation 值班轮换：成员按顺序每人连续值 ShiftDays 天 🐮🐴
+type Rotation struct {
+	ID           int
+	Name         string
+	ShiftDays    int    // 每人每班的天数
+	StartDate    string // YYYY-MM-DD，第一位成员的第一天
+	SkipHolidays bool   // 法定节假日不排班，也不计入班次天数
+	Members      []RotationMember
+	CreatedAt    time.Time
+}
+
+// RotationMember 轮换成员，按 Position 排序
+type RotationMember struct {
+	UserID      int
+	DisplayName string
+	Position    int
+}
+
+// RotationShift 生成的某天值班安排
+type RotationShift struct {
+	ID           int
+	RotationID   int
+	RotationName string
+	UserID       int
+	UserName     string
+	Date         string
+}
+
+// 换班申请状态
+const (
+	SwapPending   = "pending"
+	SwapAccepted  = "accepted"
+	SwapRejected  = "rejected"
+	SwapCancelled = "cancelled"
+)
+
+// RotationSwap 换班申请：申请人用自己的一天换对方的一天，对方接受后生效
+type RotationSwap struct {
+	ID            int
+	RotationID    int
+	RotationName  string
+	RequesterID   int
+	RequesterName string
+	RequesterDate string
+	TargetID      int
+	TargetName    string
+	TargetDate    string
+	Status        string
+	CreatedAt     time.Time
+}
+
+// ScheduleChanges 接受换班后双方日程的改动：userID -> 日期 -> 状态。
+// 交出的班次清除显式设置（回落到节假日 / 周期规则），接过的班次设为值班
+func (s RotationSwap) ScheduleChanges() map[int]map[string]int {
+	return map[int]map[string]int{
+		s.RequesterID: {s.RequesterDate: StatusUnset, s.TargetDate: StatusFire},
+		s.TargetID:    {s.TargetDate: StatusUnset, s.RequesterDate: StatusFire},
+	}
+}
+
+// StatusText 换班申请状态的中文名称
+func (s RotationSwap) StatusText() string {
+	switch s.Status {
+	case SwapPending:
+		return "待确认"
+	case SwapAccepted:
+		return "已接受"
+	case SwapRejected:
+		return "已拒绝"
+	case SwapCancelled:
+		return "已撤回"
+	}
+	return s.Status
+}
+
+// ScheduleStatus 日程状态定义（由后台维护）
+type ScheduleStatus struct {
+	Code      int
+	Label     string // 状态名称
+	Emoji     string // 日期格子中显示的标记
+	Color     string // 背景色，如 #a8e6cf
+	SortOrder int    // 排序，同时决定点击切换的顺序
+	Active    bool   // 停用后不再出现在切换循环中，已有数据仍正常显示
+	IsOff     bool   // 计为不上班（休息、病假等），用于统计在岗人数
+}
+
 // ExpenseRecord 费用记录
 type ExpenseRecord struct {
 	ID         int
-	StartDate  string  // YYYY-MM-DD
-	EndDate    string  // YYYY-MM-DD
-	AccountFee float64 // 账户费用
-	ServerFee  float64 // 服务器费用（年费）
-	CreatedAt  time.Time
+	StartDate  string // YYYY-MM-DD
+	EndDate    string // YYYY-MM-DD
+	AccountFee Cents  // 账户费用
+	ServerFee  Cents  // 服务器费用（按 AmortizeMonths 个月摊销）
+	// 分摊方式及参数
+	Strategy       string
+	UnitQuota      float64
+	AmortizeMonths int
+	TierRate       float64
+	HeadCount      int // 分摊服务器费用的人数，0 表示旧记录未保存
+	FormulaVersion int // 保存时的分摊公式版本
+	// 发票核对
+	Invoiced      bool   // 是否已录入发票金额
+	InvoiceTotal  Cents  // 实际支付给服务商的金额
+	RemainderMode string // 发票金额与分摊合计之差的处理方式
+	GroupID       int    // 按分组计算时的分组，0 表示全部用户
+	GroupName     string
+	CreatedAt     time.Time
+}
+
+// Params 记录保存的分摊参数
+func (r ExpenseRecord) Params() AllocationParams {
+	return AllocationParams{
+		Strategy:       r.Strategy,
+		AccountFee:     r.AccountFee,
+		ServerFee:      r.ServerFee,
+		UnitQuota:      r.UnitQuota,
+		AmortizeMonths: r.AmortizeMonths,
+		TierRate:       r.TierRate,
+		HeadCount:      r.HeadCount,
+	}
+}
+
+// ScopeName 记录的计算范围
+func (r ExpenseRecord) ScopeName() string {
+	switch {
+	case r.GroupID == 0:
+		return "全部用户"
+	case r.GroupName == "":
+		return "已删除分组"
+	}
+	return r.GroupName
+}
+
+// StrategyLabel 分摊方式名称
+func (r ExpenseRecord) StrategyLabel() string {
+	return allocationLabel(r.Strategy)
 }
 
 // ExpenseUsage 用户使用量记录
@@ -44,7 +454,12 @@ type ExpenseUsage struct {
 	Usage          float64 // 使用量
 	DiscountUsage  float64 // 折扣使用量
 	DiscountRate   float64 // 折扣率
-	CalculatedCost float64 // 计算出的费用
+	CalculatedCost Cents   // 计算出的费用
+	// 付款登记
+	PaidAmount Cents  // 已付金额
+	PaidDate   string // 付款日期 YYYY-MM-DD，未付款时为空
+	PayMethod  string // 付款方式
+	PayNote    string // 备注
 }
 
 func (e ExpenseUsage) TotalUsage() float64 {
@@ -53,6 +468,6 @@ func (e ExpenseUsage) TotalUsage() float64 {
 
 // 默认费用配置
 const (
-	DefaultAccountFee = 550.0
-	DefaultServerFee  = 99.0
+	DefaultAccountFee Cents = 55000
+	DefaultServerFee  Cents = 9900
 )
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Cents 金额，以分为单位的整数，避免浮点误差
+type Cents int64
+
+// String 显示为元，保留两位小数，如 "592.04"、"-1.00"
+func (c Cents) String() string {
+	sign := ""
+	if c < 0 {
+		sign, c = "-", -c
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, c/100, c%100)
+}
+
+// Yuan 以元为单位的浮点数，只用于写入旧的 REAL 列
+func (c Cents) Yuan() float64 {
+	return float64(c) / 100
+}
+
+// 金额格式：可选负号，整数部分和最多两位小数，至少包含一位数字
+var centsRe = regexp.MustCompile(`^-?\d*(\.\d{1,2})?$`)
+
+// 可以输入的最大金额（元），避免换算成分时溢出
+const maxYuan = 1_000_000_000_000
+
+// parseCents 解析以元为单位的金额字符串，最多两位小数，不经过浮点数
+func parseCents(s string) (Cents, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	if !centsRe.MatchString(s) || strings.Trim(s, "-.") == "" {
+		return 0, fmt.Errorf("金额格式错误，最多两位小数: %s", s)
+	}
+	neg := strings.HasPrefix(s, "-")
+	whole, frac, _ := strings.Cut(strings.TrimPrefix(s, "-"), ".")
+	if whole == "" {
+		whole = "0"
+	}
+	yuan, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil || yuan > maxYuan {
+		return 0, fmt.Errorf("金额超出范围: %s", s)
+	}
+	var fen int64
+	if frac != "" {
+		fen, _ = strconv.ParseInt(frac+strings.Repeat("0", 2-len(frac)), 10, 64)
+	}
+
+	c := Cents(yuan*100 + fen)
+	if neg {
+		c = -c
+	}
+	return c, nil
+}
+
+// distributeCents 把以分为单位的精确金额（可含小数）取整，保证合计等于精确合计四舍五入后的金额。
+//
+// 取整规则：每人先向下取整到分，差额按小数部分从大到小逐分补给，小数部分相同时按 keys 顺序。
+func distributeCents(keys []int, exact map[int]float64) (map[int]Cents, Cents) {
+	var sum float64
+	for _, k := range keys {
+		sum += exact[k]
+	}
+	total := Cents(math.Round(sum))
+
+	result := make(map[int]Cents)
+	var floored Cents
+	order := make([]int, len(keys))
+	copy(order, keys)
+	for _, k := range keys {
+		// 加一点容差，避免 0.29*100 这类浮点误差被向下取整成 28
+		c := Cents(math.Floor(exact[k] + 1e-6))
+		result[k] = c
+		floored += c
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return exact[order[i]]-float64(result[order[i]]) > exact[order[j]]-float64(result[order[j]])
+	})
+
+	for i := 0; floored < total && len(order) > 0; i = (i + 1) % len(order) {
+		result[order[i]]++
+		floored++
+	}
+	// 容差导致多出的分从小数部分最小的人扣回
+	for i := len(order) - 1; floored > total && i >= 0; i-- {
+		result[order[i]]--
+		floored--
+	}
+	return result, total
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseCents(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Cents
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"0", 0, false},
+		{"550", 55000, false},
+		{"592.04", 59204, false},
+		{"0.29", 29, false},
+		{"1.5", 150, false},
+		{".5", 50, false},
+		{" 12.30 ", 1230, false},
+		{"-1", -100, false},
+		{"-0.01", -1, false},
+		{"1000000000000", 100000000000000, false},
+
+		{"--5", 0, true},
+		{"1.+5", 0, true},
+		{"1.-5", 0, true},
+		{"+5", 0, true},
+		{"-", 0, true},
+		{".", 0, true},
+		{"-.", 0, true},
+		{"1.", 0, true},
+		{"1.234", 0, true},
+		{"1,5", 0, true},
+		{"abc", 0, true},
+		{"1e3", 0, true},
+		{"1000000000001", 0, true},
+		{"99999999999999999999", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseCents(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseCents(%q) = %v, want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseCents(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestCentsString(t *testing.T) {
+	tests := []struct {
+		in   Cents
+		want string
+	}{
+		{0, "0.00"},
+		{5, "0.05"},
+		{59204, "592.04"},
+		{-1, "-0.01"},
+		{-100, "-1.00"},
+	}
+	for _, tt := range tests {
+		if got := tt.in.String(); got != tt.want {
+			t.Errorf("Cents(%d).String() = %q, want %q", int64(tt.in), got, tt.want)
+		}
+	}
+}
+
+func TestDistributeCents(t *testing.T) {
+	tests := []struct {
+		name      string
+		keys      []int
+		exact     map[int]float64
+		wantTotal Cents
+		want      map[int]Cents
+	}{
+		{
+			name:      "empty",
+			wantTotal: 0,
+			want:      map[int]Cents{},
+		},
+		{
+			name:      "thirds",
+			keys:      []int{1, 2, 3},
+			exact:     map[int]float64{1: 10000.0 / 3, 2: 10000.0 / 3, 3: 10000.0 / 3},
+			wantTotal: 10000,
+			want:      map[int]Cents{1: 3334, 2: 3333, 3: 3333},
+		},
+		{
+			name:      "largest remainder first",
+			keys:      []int{1, 2, 3},
+			exact:     map[int]float64{1: 100.2, 2: 100.7, 3: 100.1},
+			wantTotal: 301,
+			want:      map[int]Cents{1: 100, 2: 101, 3: 100},
+		},
+		{
+			name:      "float noise does not lose a cent",
+			keys:      []int{1},
+			exact:     map[int]float64{1: 0.29 * 100},
+			wantTotal: 29,
+			want:      map[int]Cents{1: 29},
+		},
+		{
+			name:      "negative amounts",
+			keys:      []int{1, 2, 3},
+			exact:     map[int]float64{1: -256.0 / 3, 2: -256.0 / 3, 3: -256.0 / 3},
+			wantTotal: -256,
+			want:      map[int]Cents{1: -85, 2: -85, 3: -86},
+		},
+		{
+			name:      "mixed signs",
+			keys:      []int{1, 2},
+			exact:     map[int]float64{1: 10.5, 2: -3.5},
+			wantTotal: 7,
+		},
+	}
+	for _, tt := range tests {
+		got, total := distributeCents(tt.keys, tt.exact)
+		if total != tt.wantTotal {
+			t.Errorf("%s: total = %d, want %d", tt.name, total, tt.wantTotal)
+		}
+		var sum Cents
+		for _, c := range got {
+			sum += c
+		}
+		if sum != total {
+			t.Errorf("%s: parts sum to %d, total is %d", tt.name, sum, total)
+		}
+		for k, want := range tt.want {
+			if got[k] != want {
+				t.Errorf("%s: key %d = %d, want %d", tt.name, k, got[k], want)
+			}
+		}
+		if len(got) != len(tt.keys) {
+			t.Errorf("%s: got %d parts, want %d", tt.name, len(got), len(tt.keys))
+		}
+	}
+}
+
+// 分摊结果每人取整后合计必须等于总额
+func TestAllocateExpenseSumsToTotal(t *testing.T) {
+	inputs := map[int]UserExpenseInput{
+		2: {Usage: 3000},
+		3: {Usage: 10},
+		4: {Usage: 0},
+		5: {Usage: 1234.5, DiscountUsage: 100, DiscountRate: 0.5},
+	}
+	for _, s := range allocationStrategies {
+		p := defaultAllocationParams()
+		p.Strategy = s.Name
+		p.HeadCount = 7
+		results, _, total, err := allocateExpense(p, inputs)
+		if err != nil {
+			t.Fatalf("%s: %v", s.Name, err)
+		}
+		var sum Cents
+		for _, r := range results {
+			sum += r.Cost
+		}
+		if sum != total {
+			t.Errorf("%s: costs sum to %v, total is %v", s.Name, sum, total)
+		}
+	}
+}
+
+// 旧数据库只有以元为单位的 REAL 列，启动时换算成分
+func TestCentsMigration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy.db")
+	legacy, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []string{
+		`CREATE TABLE expense_records (id INTEGER PRIMARY KEY AUTOINCREMENT, start_date TEXT NOT NULL, end_date TEXT NOT NULL,
+			account_fee REAL NOT NULL DEFAULT 550, server_fee REAL NOT NULL DEFAULT 99, created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP)`,
+		`CREATE TABLE expense_usages (id INTEGER PRIMARY KEY AUTOINCREMENT, expense_id INTEGER NOT NULL, user_id INTEGER NOT NULL,
+			usage REAL NOT NULL DEFAULT 0, supplement REAL NOT NULL DEFAULT 0, calculated_cost REAL NOT NULL DEFAULT 0)`,
+		`INSERT INTO expense_records (start_date, end_date, account_fee, server_fee) VALUES ('2025-01-01', '2025-01-31', 550.1, 99)`,
+		`INSERT INTO expense_usages (expense_id, user_id, usage, calculated_cost) VALUES (1, 2, 100, 29.366666), (1, 3, 10, 0.29)`,
+	} {
+		if _, err := legacy.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	legacy.Close()
+
+	initDB(path)
+	defer db.Close()
+
+	record, err := getExpenseRecordByID(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.AccountFee != 55010 || record.ServerFee != 9900 {
+		t.Errorf("fees = %v, %v, want 550.10, 99.00", record.AccountFee, record.ServerFee)
+	}
+	usages, err := getExpenseUsages(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int]Cents{2: 2937, 3: 29}
+	for _, u := range usages {
+		if u.CalculatedCost != want[u.UserID] {
+			t.Errorf("user %d cost = %v, want %v", u.UserID, u.CalculatedCost, want[u.UserID])
+		}
+	}
+}
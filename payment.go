@@ -0,0 +1,158 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// 付款状态，由已付金额和应付金额得出
+const (
+	PaymentUnpaid  = "unpaid"
+	PaymentPartial = "partial"
+	PaymentPaid    = "paid"
+)
+
+// 费用周期结束后超过这么多天仍未付清视为逾期
+const PaymentDueDays = 15
+
+// 付款方式选项
+var payMethods = []string{"微信", "支付宝", "银行转账", "现金", "其他"}
+
+// validPayMethod 是否为可选的付款方式，空表示未填写
+func validPayMethod(method string) bool {
+	if method == "" {
+		return true
+	}
+	for _, m := range payMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// ExpenseBalance 某人某期的应付、已付情况
+type ExpenseBalance struct {
+	ExpenseUsage
+	Record  ExpenseRecord
+	Due     Cents  // 应付金额，包含尾差调整
+	DueDate string // 付款截止日期
+	Overdue bool   // 已过截止日期且未付清
+}
+
+// Outstanding 未付金额，负数表示多付
+func (b ExpenseBalance) Outstanding() Cents {
+	return b.Due - b.PaidAmount
+}
+
+// Status 付款状态
+func (b ExpenseBalance) Status() string {
+	switch {
+	case b.Outstanding() <= 0:
+		return PaymentPaid
+	case b.PaidAmount > 0:
+		return PaymentPartial
+	}
+	return PaymentUnpaid
+}
+
+// StatusText 付款状态的中文名称
+func (b ExpenseBalance) StatusText() string {
+	switch b.Status() {
+	case PaymentPaid:
+		return "已付清"
+	case PaymentPartial:
+		return "部分付款"
+	}
+	return "未付款"
+}
+
+// paymentDueDate 费用周期的付款截止日期
+func paymentDueDate(record ExpenseRecord) string {
+	end, err := time.Parse("2006-01-02", record.EndDate)
+	if err != nil {
+		return record.EndDate
+	}
+	return end.AddDate(0, 0, PaymentDueDays).Format("2006-01-02")
+}
+
+// expenseBalances 一条费用记录中每个人的付款情况，rc 为 nil 时应付金额即分摊费用
+func expenseBalances(record ExpenseRecord, rc *ExpenseReconcile, usages []ExpenseUsage, today time.Time) []ExpenseBalance {
+	dueDate := paymentDueDate(record)
+	list := make([]ExpenseBalance, 0, len(usages))
+	for _, u := range usages {
+		b := ExpenseBalance{ExpenseUsage: u, Record: record, Due: u.CalculatedCost, DueDate: dueDate}
+		if rc != nil {
+			b.Due = rc.Due(u)
+		}
+		b.Overdue = b.Outstanding() > 0 && today.Format("2006-01-02") > dueDate
+		list = append(list, b)
+	}
+	return list
+}
+
+// getExpenseBalances 所有费用记录中每个人的付款情况，最新的周期在前；userID 不为 0 时只返回该用户的
+func getExpenseBalances(today time.Time, userID int) ([]ExpenseBalance, error) {
+	records, err := getAllExpenseRecords()
+	if err != nil {
+		return nil, err
+	}
+	totals, err := getExpenseCostTotals()
+	if err != nil {
+		return nil, err
+	}
+	reconciles := reconcileExpenses(records, totals)
+	usagesByRecord, err := getExpenseUsagesByRecord(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []ExpenseBalance
+	for _, record := range records {
+		usages := usagesByRecord[record.ID]
+		rc := reconciles[record.ID]
+		rc.spread(usages)
+		for _, b := range expenseBalances(record, rc, usages, today) {
+			if userID == 0 || b.UserID == userID {
+				list = append(list, b)
+			}
+		}
+	}
+	return list, nil
+}
+
+// UserBalanceSummary 某人所有周期的欠款汇总
+type UserBalanceSummary struct {
+	UserID      int
+	Username    string
+	DisplayName string
+	Outstanding Cents // 未付合计（多付的周期会抵扣）
+	Overdue     Cents // 其中已逾期的金额
+	OpenPeriods int   // 未付清的周期数
+}
+
+// summarizeBalances 按用户汇总付款情况，欠款多的在前
+func summarizeBalances(list []ExpenseBalance) []UserBalanceSummary {
+	index := make(map[int]int)
+	var summaries []UserBalanceSummary
+	for _, b := range list {
+		i, ok := index[b.UserID]
+		if !ok {
+			i = len(summaries)
+			index[b.UserID] = i
+			summaries = append(summaries, UserBalanceSummary{UserID: b.UserID, Username: b.Username, DisplayName: b.DisplayName})
+		}
+		s := &summaries[i]
+		s.Outstanding += b.Outstanding()
+		if b.Overdue {
+			s.Overdue += b.Outstanding()
+		}
+		if b.Status() != PaymentPaid {
+			s.OpenPeriods++
+		}
+	}
+	sort.SliceStable(summaries, func(i, j int) bool {
+		return summaries[i].Outstanding > summaries[j].Outstanding
+	})
+	return summaries
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"sort"
+)
+
+// 发票金额与分摊合计之差（尾差）的处理方式
+const (
+	RemainderAbsorb = "absorb" // 由 admin 承担
+	RemainderSpread = "spread" // 按各人费用比例分摊
+	RemainderCarry  = "carry"  // 结转到下一期
+)
+
+// remainderMode 一种尾差处理方式
+type remainderMode struct {
+	Name  string
+	Label string
+}
+
+var remainderModes = []remainderMode{
+	{RemainderAbsorb, "由 admin 承担"},
+	{RemainderSpread, "按费用比例分摊给用户"},
+	{RemainderCarry, "结转到下一期"},
+}
+
+// validRemainderMode 是否为已知的尾差处理方式
+func validRemainderMode(name string) bool {
+	for _, m := range remainderModes {
+		if m.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// remainderModeLabel 尾差处理方式名称，用于页面显示
+func remainderModeLabel(name string) string {
+	for _, m := range remainderModes {
+		if m.Name == name {
+			return m.Label
+		}
+	}
+	return name
+}
+
+// ExpenseReconcile 一条费用记录的发票核对结果。
+// 尾差 = 发票金额 + 上期结转 - 分摊合计，正数表示少收，负数表示多收
+type ExpenseReconcile struct {
+	Mode        string
+	Invoiced    bool
+	Invoice     Cents
+	Allocated   Cents         // 已分摊给用户的费用合计
+	CarryIn     Cents         // 上一期结转过来的尾差
+	Remainder   Cents         // 需要处理的尾差，未录入发票时为 0
+	AdminShare  Cents         // 由 admin 承担的部分
+	CarryOut    Cents         // 结转到下一期的部分
+	Adjustments map[int]Cents // 按比例分摊时每个用户增加（或减少）的费用
+}
+
+// Gap 本期发票金额与分摊合计之差，不含上期结转
+func (rc *ExpenseReconcile) Gap() Cents {
+	return rc.Invoice - rc.Allocated
+}
+
+// ModeLabel 尾差处理方式名称
+func (rc *ExpenseReconcile) ModeLabel() string {
+	return remainderModeLabel(rc.Mode)
+}
+
+// Due 用户本期应付金额：分摊费用加上尾差调整
+func (rc *ExpenseReconcile) Due(u ExpenseUsage) Cents {
+	return u.CalculatedCost + rc.Adjustments[u.UserID]
+}
+
+// reconcileExpenses 按记录时间顺序核对所有费用记录，结转的尾差计入同一范围（分组或全部用户）的下一条记录。
+// 未录入发票的记录无法核对，上期结转原样顺延
+func reconcileExpenses(records []ExpenseRecord, totals map[int]Cents) map[int]*ExpenseReconcile {
+	sorted := make([]ExpenseRecord, len(records))
+	copy(sorted, records)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if !sorted[i].CreatedAt.Equal(sorted[j].CreatedAt) {
+			return sorted[i].CreatedAt.Before(sorted[j].CreatedAt)
+		}
+		return sorted[i].ID < sorted[j].ID
+	})
+
+	result := make(map[int]*ExpenseReconcile)
+	carry := make(map[int]Cents) // 按 GroupID 分别结转
+	for _, r := range sorted {
+		rc := &ExpenseReconcile{
+			Mode:      r.RemainderMode,
+			Invoiced:  r.Invoiced,
+			Invoice:   r.InvoiceTotal,
+			Allocated: totals[r.ID],
+			CarryIn:   carry[r.GroupID],
+		}
+		if !r.Invoiced {
+			rc.CarryOut = rc.CarryIn
+		} else {
+			rc.Remainder = rc.Invoice + rc.CarryIn - rc.Allocated
+			switch rc.Mode {
+			case RemainderCarry:
+				rc.CarryOut = rc.Remainder
+			case RemainderSpread:
+				// 每人的调整在 spread 中按使用量记录计算
+			default:
+				rc.AdminShare = rc.Remainder
+			}
+		}
+		carry[r.GroupID] = rc.CarryOut
+		result[r.ID] = rc
+	}
+	return result
+}
+
+// spread 按比例分摊时，把尾差按各人费用占比分给用户，取整方式与费用计算相同。
+// 分摊合计为 0 时平均分配，没有用户时仍由 admin 承担
+func (rc *ExpenseReconcile) spread(usages []ExpenseUsage) {
+	if !rc.Invoiced || rc.Mode != RemainderSpread || rc.Remainder == 0 {
+		return
+	}
+	if len(usages) == 0 {
+		rc.AdminShare = rc.Remainder
+		return
+	}
+
+	var userIDs []int
+	exact := make(map[int]float64)
+	for _, u := range usages {
+		userIDs = append(userIDs, u.UserID)
+		if rc.Allocated != 0 {
+			exact[u.UserID] = float64(rc.Remainder) * float64(u.CalculatedCost) / float64(rc.Allocated)
+		} else {
+			exact[u.UserID] = float64(rc.Remainder) / float64(len(usages))
+		}
+	}
+	sort.Ints(userIDs)
+	rc.Adjustments, _ = distributeCents(userIDs, exact)
+}
+
+// getExpenseReconcile 核对一条费用记录，需要之前所有记录的结转情况
+func getExpenseReconcile(id int, usages []ExpenseUsage) (*ExpenseReconcile, error) {
+	records, err := getAllExpenseRecords()
+	if err != nil {
+		return nil, err
+	}
+	totals, err := getExpenseCostTotals()
+	if err != nil {
+		return nil, err
+	}
+	rc, ok := reconcileExpenses(records, totals)[id]
+	if !ok {
+		return nil, nil
+	}
+	rc.spread(usages)
+	return rc, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// 结转只在同一范围（分组）内进行
+func TestReconcileCarryStaysInScope(t *testing.T) {
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	records := []ExpenseRecord{
+		{ID: 1, GroupID: 1, Invoiced: true, InvoiceTotal: 1000, RemainderMode: RemainderCarry, CreatedAt: base},
+		{ID: 2, GroupID: 2, Invoiced: true, InvoiceTotal: 500, RemainderMode: RemainderAbsorb, CreatedAt: base.Add(time.Hour)},
+		{ID: 3, GroupID: 1, RemainderMode: RemainderAbsorb, CreatedAt: base.Add(2 * time.Hour)},
+		{ID: 4, GroupID: 1, Invoiced: true, InvoiceTotal: 800, RemainderMode: RemainderAbsorb, CreatedAt: base.Add(3 * time.Hour)},
+	}
+	totals := map[int]Cents{1: 900, 2: 500, 3: 700, 4: 800}
+
+	rcs := reconcileExpenses(records, totals)
+	if got := rcs[1].CarryOut; got != 100 {
+		t.Errorf("record 1 carry out = %v, want 1.00", got)
+	}
+	if got := rcs[2].CarryIn; got != 0 {
+		t.Errorf("record 2 (other group) carry in = %v, want 0", got)
+	}
+	// 未录入发票的记录原样顺延
+	if got := rcs[3].CarryOut; got != 100 {
+		t.Errorf("record 3 carry out = %v, want 1.00", got)
+	}
+	if rc := rcs[4]; rc.CarryIn != 100 || rc.AdminShare != 100 {
+		t.Errorf("record 4 carry in = %v, admin share = %v, want 1.00, 1.00", rc.CarryIn, rc.AdminShare)
+	}
+}
+
+// 按比例分摊的调整合计等于尾差，负数尾差同样成立
+func TestReconcileSpread(t *testing.T) {
+	for _, remainder := range []Cents{256, -7} {
+		rc := &ExpenseReconcile{Mode: RemainderSpread, Invoiced: true, Allocated: 10000, Remainder: remainder}
+		rc.spread([]ExpenseUsage{
+			{UserID: 2, CalculatedCost: 3334},
+			{UserID: 3, CalculatedCost: 3333},
+			{UserID: 4, CalculatedCost: 3333},
+		})
+		var sum Cents
+		for _, c := range rc.Adjustments {
+			sum += c
+		}
+		if sum != remainder {
+			t.Errorf("adjustments sum to %v, want %v", sum, remainder)
+		}
+	}
+}
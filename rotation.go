@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// 排班最多向后生成的月数
+const MaxRotationMonths = 12
+
+// assignRotation 计算 [from, to] 内每天的值班成员（日期 -> 用户 ID）
+//
+// 从 StartDate 起按成员顺序轮换，每人连续 ShiftDays 天；SkipHolidays 时法定节假日
+// 不排班，也不计入班次天数，节后由原来的成员继续
+func assignRotation(rt Rotation, from, to time.Time, holidays map[string]Holiday) (map[string]int, error) {
+	if len(rt.Members) == 0 {
+		return nil, fmt.Errorf("轮换没有成员")
+	}
+	if rt.ShiftDays < 1 {
+		return nil, fmt.Errorf("每班天数至少为 1")
+	}
+	start, err := time.Parse("2006-01-02", rt.StartDate)
+	if err != nil {
+		return nil, fmt.Errorf("开始日期格式错误")
+	}
+
+	result := make(map[string]int)
+	slot := 0 // 从开始日期起已排班的天数
+	for d := start; !d.After(to); d = d.AddDate(0, 0, 1) {
+		date := d.Format("2006-01-02")
+		if h, ok := holidays[date]; ok && rt.SkipHolidays && h.Kind == HolidayKindHoliday {
+			continue
+		}
+		if !d.Before(from) {
+			member := rt.Members[(slot/rt.ShiftDays)%len(rt.Members)]
+			result[date] = member.UserID
+		}
+		slot++
+	}
+	return result, nil
+}
@@ -0,0 +1,247 @@
+// 日历格子编辑：点击或拖选后弹出状态选择
+// 依赖页面先定义 STATUSES（code -> {class, label, name}）和 PICKER_STATUSES（可选状态列表）
+
+// 周末掩码外的工作日：bit0=周日 ... bit6=周六
+const WORKDAY_MASK = 0b0111110;
+
+const picker = document.getElementById('status-picker');
+let pickerTarget = null;
+let drag = null;
+
+// 拖选：在同一个选择范围（.select-scope，如一个人的月历）内按下并拖动，松开后对选中范围弹出状态选择
+document.addEventListener('mousedown', e => {
+    if (!picker.hidden && !picker.contains(e.target)) closePicker();
+    const cell = e.target.closest('.day-cell.editable');
+    if (!cell || e.button !== 0) return;
+    e.preventDefault();
+    drag = {
+        scope: cell.closest('.select-scope'),
+        userID: cell.dataset.userId,
+        anchor: cell.dataset.date,
+        current: cell.dataset.date
+    };
+    markSelection(drag.scope, drag.anchor, drag.current);
+});
+
+document.addEventListener('mouseover', e => {
+    if (!drag) return;
+    const cell = e.target.closest('.day-cell.editable');
+    if (!cell || cell.closest('.select-scope') !== drag.scope) return;
+    drag.current = cell.dataset.date;
+    markSelection(drag.scope, drag.anchor, drag.current);
+});
+
+document.addEventListener('mouseup', e => {
+    if (!drag) return;
+    const d = drag;
+    drag = null;
+    const start = d.anchor < d.current ? d.anchor : d.current;
+    const end = d.anchor < d.current ? d.current : d.anchor;
+    const cells = markSelection(d.scope, start, end);
+    openPicker({userID: d.userID, start: start, end: end, cells: cells});
+});
+
+// 不能编辑的格子点击后打开当天的备注和评论
+document.addEventListener('click', e => {
+    const cell = e.target.closest('.day-cell[data-date]:not(.editable)');
+    if (cell) location.href = dayURL(cell);
+});
+
+function dayURL(cell) {
+    return '/schedule/day?user_id=' + cell.dataset.userId + '&date=' + cell.dataset.date;
+}
+
+document.addEventListener('keydown', e => {
+    if (e.key === 'Escape') closePicker();
+});
+
+// 高亮 [from, to] 范围内的格子并返回它们（日期字符串可直接比较）
+function markSelection(scope, from, to) {
+    const lo = from < to ? from : to;
+    const hi = from < to ? to : from;
+    const cells = [];
+    scope.querySelectorAll('.day-cell.editable').forEach(c => {
+        const inRange = c.dataset.date >= lo && c.dataset.date <= hi;
+        c.classList.toggle('selected', inRange);
+        if (inRange) cells.push(c);
+    });
+    return cells;
+}
+
+// 打开状态选择弹窗，target 为单日或日期范围
+function openPicker(target) {
+    pickerTarget = target;
+    picker.innerHTML = '';
+    const isRange = target.start !== target.end;
+
+    let skipWeekend = null;
+    if (isRange) {
+        const title = document.createElement('div');
+        title.className = 'picker-title';
+        title.textContent = target.start + ' ~ ' + target.end;
+        picker.appendChild(title);
+
+        const label = document.createElement('label');
+        label.className = 'picker-title';
+        skipWeekend = document.createElement('input');
+        skipWeekend.type = 'checkbox';
+        label.appendChild(skipWeekend);
+        label.appendChild(document.createTextNode(' 跳过周末'));
+        picker.appendChild(label);
+    }
+
+    // 单日可以只设置上午或下午
+    let half = '';
+    if (!isRange) {
+        const halves = document.createElement('div');
+        halves.className = 'picker-halves';
+        [['', '全天'], ['am', '上午'], ['pm', '下午']].forEach(([value, text]) => {
+            const b = document.createElement('button');
+            b.type = 'button';
+            b.textContent = text;
+            b.classList.toggle('active', value === half);
+            b.onclick = () => {
+                half = value;
+                halves.querySelectorAll('button').forEach(x => x.classList.toggle('active', x === b));
+            };
+            halves.appendChild(b);
+        });
+        picker.appendChild(halves);
+    }
+
+    const current = target.cells[0].dataset.status;
+    PICKER_STATUSES.forEach(st => {
+        const btn = document.createElement('button');
+        btn.type = 'button';
+        btn.className = 'picker-option day-cell ' + statusClass(st.Code);
+        if (!isRange && String(st.Code) === current) btn.classList.add('current');
+        btn.textContent = st.Emoji ? st.Emoji + ' ' + st.Label : st.Label;
+        btn.onclick = () => {
+            const t = pickerTarget;
+            closePicker();
+            if (isRange) {
+                setRangeStatus(t, st.Code, skipWeekend.checked ? WORKDAY_MASK : 0);
+            } else {
+                setStatus(t.cells[0], t.userID, t.start, st.Code, half);
+            }
+        };
+        picker.appendChild(btn);
+    });
+
+    if (!isRange) {
+        const link = document.createElement('a');
+        link.className = 'picker-link';
+        link.href = dayURL(target.cells[0]);
+        link.textContent = '备注 / 评论';
+        picker.appendChild(link);
+    }
+
+    const rect = target.cells[target.cells.length - 1].getBoundingClientRect();
+    picker.style.top = (window.scrollY + rect.bottom + 4) + 'px';
+    picker.style.left = (window.scrollX + rect.left) + 'px';
+    picker.hidden = false;
+}
+
+function closePicker() {
+    picker.hidden = true;
+    if (pickerTarget) {
+        pickerTarget.cells.forEach(c => c.classList.remove('selected'));
+    }
+    pickerTarget = null;
+}
+
+function postForm(url, params) {
+    return fetch(url, {
+        method: 'POST',
+        headers: {'Content-Type': 'application/x-www-form-urlencoded'},
+        body: new URLSearchParams(params)
+    })
+    .then(r => {
+        if (!r.ok) return r.text().then(t => { throw new Error(t); });
+        return r.json();
+    });
+}
+
+// 保存成功但需要提醒（如超出年假额度）
+function showWarning(data) {
+    if (data.warning) setTimeout(() => alert(data.warning), 0);
+}
+
+function setStatus(el, userID, date, status, half) {
+    postForm('/schedule', {user_id: userID, date: date, status: status, half: half || ''})
+    .then(data => {
+        updateCell(el, data);
+        showWarning(data);
+    })
+    .catch(err => alert('保存失败：' + err.message));
+}
+
+function setRangeStatus(target, status, weekdays) {
+    postForm('/schedule/range', {
+        user_id: target.userID,
+        start: target.start,
+        end: target.end,
+        status: status,
+        weekdays: weekdays
+    })
+    .then(data => {
+        const changed = new Set(data.dates);
+        target.cells.forEach(c => {
+            if (changed.has(c.dataset.date)) updateCell(c, data);
+        });
+        showWarning(data);
+    })
+    .catch(err => alert('保存失败：' + err.message));
+}
+
+// 设置后该日期变为显式设置，去掉周期规则标记
+// data 为接口返回：status 为全天或上午，pm_status 为下午，edited_by 非空表示代他人修改
+function updateCell(el, data) {
+    const am = data.status;
+    const pm = data.pm_status || am;
+    el.classList.remove(statusClass(Number(el.dataset.status)), 'from-rule');
+    el.classList.add(statusClass(am));
+    el.classList.toggle('split', am !== pm);
+    el.classList.toggle('edited-by-other', !!data.edited_by);
+    // 节假日、待审批、评论数、人数不足等由服务端渲染在 data-title-* 中，这里只重建随修改变化的部分
+    const tips = [];
+    if (el.dataset.titlePrefix) tips.push(el.dataset.titlePrefix);
+    if (am !== pm) tips.push('上午' + statusName(am) + '，下午' + statusName(pm));
+    if (data.edited_by) tips.push('由 ' + data.edited_by + ' 修改');
+    if (el.dataset.titleSuffix) tips.push(el.dataset.titleSuffix.trim());
+    if (el.dataset.note) tips.push('备注：' + el.dataset.note);
+    el.title = tips.join(' ');
+    el.dataset.status = am;
+    el.dataset.pmStatus = am !== pm ? pm : 0;
+
+    let halfEl = el.querySelector('.day-half');
+    if (am !== pm) {
+        if (!halfEl) {
+            halfEl = document.createElement('span');
+            el.prepend(halfEl);
+        }
+        halfEl.className = 'day-half ' + statusClass(pm);
+    } else if (halfEl) {
+        halfEl.remove();
+    }
+    el.querySelector('.day-label').textContent = am !== pm
+        ? halfLabel(am) + '/' + halfLabel(pm)
+        : statusLabel(am);
+}
+
+function statusClass(s) {
+    return STATUSES[s] ? STATUSES[s].class : 'default';
+}
+
+function statusName(s) {
+    return STATUSES[s] ? STATUSES[s].name : '未知状态 ' + s;
+}
+
+function statusLabel(s) {
+    return STATUSES[s] ? STATUSES[s].label : '';
+}
+
+// 半天的标记，与后端 halfLabel 一致
+function halfLabel(s) {
+    return statusLabel(s) || '-';
+}
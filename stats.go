@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// 统计周期
+const (
+	PeriodMonth   = "month"
+	PeriodQuarter = "quarter"
+	PeriodYear    = "year"
+)
+
+// UserStats 单个用户在统计周期内的数据
+type UserStats struct {
+	UserID      int             `json:"user_id"`
+	Username    string          `json:"username"`
+	DisplayName string          `json:"display_name"`
+	Counts      map[int]float64 `json:"counts"`   // 状态编码 -> 天数（未设置的日期计为默认，半天计 0.5）
+	OffDays     float64         `json:"off_days"` // 计为休息的天数
+	// 最长连续 🐮🐴 天数及起止日期
+	LongestFireStreak int    `json:"longest_fire_streak"`
+	FireStreakStart   string `json:"fire_streak_start,omitempty"`
+	FireStreakEnd     string `json:"fire_streak_end,omitempty"`
+}
+
+// HeatmapDay 团队热力图中的一天
+type HeatmapDay struct {
+	Date    string   `json:"date"`
+	Weekday int      `json:"weekday"`
+	Working float64  `json:"working"` // 在岗人数，半天休息计 0.5
+	Total   int      `json:"total"`
+	Off     []string `json:"off"`   // 休息的人
+	Level   int      `json:"level"` // 0-4，在岗比例分档，用于着色
+}
+
+// StatsData 统计结果
+type StatsData struct {
+	Period   string           `json:"period"`
+	Label    string           `json:"label"`
+	Start    string           `json:"start"`
+	End      string           `json:"end"`
+	Prev     string           `json:"-"`
+	Next     string           `json:"-"`
+	Statuses []ScheduleStatus `json:"statuses"`
+	Users    []UserStats      `json:"users"`
+	Heatmap  []HeatmapDay     `json:"heatmap"`
+
+	HeatmapWeeks [][]HeatmapDay `json:"-"` // 按周排列的热力图，从个人设置的每周第一天开始，空白日期 Date 为空
+}
+
+// statsPeriodRange 根据周期类型和锚点月份（YYYY-MM）计算起止日期
+func statsPeriodRange(period, anchor string) (start, end time.Time, label string, err error) {
+	t, err := time.Parse("2006-01", anchor)
+	if err != nil {
+		return start, end, "", fmt.Errorf("月份格式错误")
+	}
+	switch period {
+	case PeriodMonth:
+		start = t
+		end = start.AddDate(0, 1, -1)
+		label = fmt.Sprintf("%d年%d月", t.Year(), int(t.Month()))
+	case PeriodQuarter:
+		q := (int(t.Month()) - 1) / 3
+		start = time.Date(t.Year(), time.Month(q*3+1), 1, 0, 0, 0, 0, time.UTC)
+		end = start.AddDate(0, 3, -1)
+		label = fmt.Sprintf("%d年第%d季度", t.Year(), q+1)
+	case PeriodYear:
+		start = time.Date(t.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+		end = start.AddDate(1, 0, -1)
+		label = fmt.Sprintf("%d年", t.Year())
+	default:
+		return start, end, "", fmt.Errorf("未知统计周期: %s", period)
+	}
+	return start, end, label, nil
+}
+
+// buildStats 汇总所有用户在周期内的日程，热力图按 prefs 的每周第一天排列
+func buildStats(period, anchor string, prefs CalendarPrefs) (*StatsData, error) {
+	start, end, label, err := statsPeriodRange(period, anchor)
+	if err != nil {
+		return nil, err
+	}
+
+	users, err := getAllUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	// 上一/下一周期的锚点月份
+	step := map[string]int{PeriodMonth: 1, PeriodQuarter: 3, PeriodYear: 12}[period]
+	data := &StatsData{
+		Period:   period,
+		Label:    label,
+		Start:    start.Format("2006-01-02"),
+		End:      end.Format("2006-01-02"),
+		Prev:     start.AddDate(0, -step, 0).Format("2006-01"),
+		Next:     start.AddDate(0, step, 0).Format("2006-01"),
+		Statuses: allStatuses(),
+	}
+
+	heat := make(map[string]*HeatmapDay)
+	var dates []string
+	for d := start; !d.After(end); d = d.AddDate(0, 0, 1) {
+		date := d.Format("2006-01-02")
+		dates = append(dates, date)
+		heat[date] = &HeatmapDay{Date: date, Weekday: int(d.Weekday()), Total: len(users)}
+	}
+
+	for _, u := range users {
+		schedules, err := getSchedulesRange(u.ID, start, end)
+		if err != nil {
+			return nil, err
+		}
+
+		us := UserStats{UserID: u.ID, Username: u.Username, DisplayName: u.DisplayName, Counts: make(map[int]float64)}
+		streak, streakStart := 0, ""
+		for _, date := range dates {
+			am, pm := StatusDefault, StatusDefault
+			if s, ok := schedules[date]; ok {
+				am, pm = s.Halves()
+			}
+			// 上下午各计半天
+			for _, status := range []int{am, pm} {
+				us.Counts[status] += 0.5
+				if isOffStatus(status) {
+					us.OffDays += 0.5
+				} else {
+					heat[date].Working += 0.5
+				}
+			}
+			if isOffStatus(am) || isOffStatus(pm) {
+				heat[date].Off = append(heat[date].Off, u.DisplayName)
+			}
+
+			// 任意半天 🐮🐴 都计入连续天数
+			if am == StatusFire || pm == StatusFire {
+				if streak == 0 {
+					streakStart = date
+				}
+				streak++
+				if streak > us.LongestFireStreak {
+					us.LongestFireStreak = streak
+					us.FireStreakStart = streakStart
+					us.FireStreakEnd = date
+				}
+			} else {
+				streak = 0
+			}
+		}
+		data.Users = append(data.Users, us)
+	}
+
+	for _, date := range dates {
+		h := heat[date]
+		if h.Total > 0 {
+			h.Level = int(math.Ceil(h.Working * 4 / float64(h.Total)))
+		}
+		data.Heatmap = append(data.Heatmap, *h)
+	}
+
+	// 热力图按周排列，补齐首尾空白
+	cells := make([]HeatmapDay, prefs.Offset(start.Weekday()), len(data.Heatmap)+14)
+	cells = append(cells, data.Heatmap...)
+	for len(cells)%7 != 0 {
+		cells = append(cells, HeatmapDay{})
+	}
+	for i := 0; i < len(cells); i += 7 {
+		data.HeatmapWeeks = append(data.HeatmapWeeks, cells[i:i+7])
+	}
+	return data, nil
+}
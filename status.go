@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 状态定义缓存，模板渲染时频繁读取，后台修改后刷新
+var (
+	statusCatalog []ScheduleStatus
+	statusMu      sync.RWMutex
+)
+
+// loadStatusCatalog 从数据库重新加载状态定义
+func loadStatusCatalog() {
+	statuses, err := getScheduleStatuses()
+	if err != nil {
+		log.Printf("加载日程状态失败: %v", err)
+		return
+	}
+	statusMu.Lock()
+	statusCatalog = statuses
+	statusMu.Unlock()
+}
+
+// allStatuses 返回全部状态定义（含已停用）
+func allStatuses() []ScheduleStatus {
+	statusMu.RLock()
+	defer statusMu.RUnlock()
+	return append([]ScheduleStatus(nil), statusCatalog...)
+}
+
+// activeStatuses 返回启用中的状态，按排序顺序
+func activeStatuses() []ScheduleStatus {
+	statusMu.RLock()
+	defer statusMu.RUnlock()
+	var list []ScheduleStatus
+	for _, st := range statusCatalog {
+		if st.Active {
+			list = append(list, st)
+		}
+	}
+	return list
+}
+
+func findStatus(code int) (ScheduleStatus, bool) {
+	statusMu.RLock()
+	defer statusMu.RUnlock()
+	for _, st := range statusCatalog {
+		if st.Code == code {
+			return st, true
+		}
+	}
+	return ScheduleStatus{}, false
+}
+
+// isOffStatus 该状态是否计为不上班
+func isOffStatus(code int) bool {
+	st, ok := findStatus(code)
+	return ok && st.IsOff
+}
+
+// parseStatusCode 解析并校验请求中的状态编码，只接受启用中的状态
+func parseStatusCode(s string) (int, error) {
+	code, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("状态格式错误")
+	}
+	st, ok := findStatus(code)
+	if !ok || !st.Active {
+		return 0, fmt.Errorf("未知状态: %d", code)
+	}
+	return code, nil
+}
+
+// lookupActiveStatus 按名称或编码查找启用中的状态
+func lookupActiveStatus(s string) (int, bool) {
+	for _, st := range activeStatuses() {
+		if st.Label == s || strconv.Itoa(st.Code) == s {
+			return st.Code, true
+		}
+	}
+	return 0, false
+}
+
+// defaultICSMapping 默认的 ICS 导入映射：各状态名称映射到自身，“假”映射为休息
+func defaultICSMapping() string {
+	var b strings.Builder
+	b.WriteString("# 关键词 = 状态，按顺序匹配事件标题或分类\n")
+	for _, st := range activeStatuses() {
+		if st.Code != StatusDefault {
+			fmt.Fprintf(&b, "%s = %s\n", st.Label, st.Label)
+		}
+	}
+	if st, ok := findStatus(StatusRest); ok && st.Active {
+		fmt.Fprintf(&b, "假 = %s\n", st.Label)
+	}
+	return b.String()
+}
+
+// nextStatus 返回点击切换时的下一个状态，末尾回到第一个
+func nextStatus(current int) int {
+	list := activeStatuses()
+	if len(list) == 0 {
+		return StatusDefault
+	}
+	for i, st := range list {
+		if st.Code == current {
+			return list[(i+1)%len(list)].Code
+		}
+	}
+	return list[0].Code
+}
+
+// statusClass 日期格子的 CSS class
+func statusClass(code int) string {
+	if code == StatusDefault {
+		return "default"
+	}
+	return fmt.Sprintf("status-%d", code)
+}
+
+// statusLabel 日期格子中显示的标记
+func statusLabel(code int) string {
+	if st, ok := findStatus(code); ok {
+		return st.Emoji
+	}
+	return ""
+}
+
+// statusName 状态名称，用于列表和说明文字
+func statusName(code int) string {
+	if st, ok := findStatus(code); ok {
+		return st.Label
+	}
+	return fmt.Sprintf("未知状态 %d", code)
+}
+
+// dayLabel 日期格子中的标记，分上下午时显示为 “上午/下午”
+func dayLabel(am, pm int) string {
+	if pm == 0 || pm == am {
+		return statusLabel(am)
+	}
+	return halfLabel(am) + "/" + halfLabel(pm)
+}
+
+// halfLabel 半天的标记，没有标记的状态用 “-” 占位
+func halfLabel(code int) string {
+	if label := statusLabel(code); label != "" {
+		return label
+	}
+	return "-"
+}
+
+// dayStatusName 某天的状态名称，分上下午时为 “上午 X，下午 Y”
+func dayStatusName(am, pm int) string {
+	if pm == 0 || pm == am {
+		return statusName(am)
+	}
+	return "上午" + statusName(am) + "，下午" + statusName(pm)
+}
+
+// statusStyleMap 给前端 JS 使用的状态表：code -> {class, label}
+func statusStyleMap() map[int]map[string]string {
+	m := make(map[int]map[string]string)
+	for _, st := range allStatuses() {
+		m[st.Code] = map[string]string{
+			"class": statusClass(st.Code),
+			"label": st.Emoji,
+			"name":  st.Label,
+		}
+	}
+	return m
+}
+
+// 根据状态定义生成的样式表
+func handleStatusCSS(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	for _, st := range allStatuses() {
+		fmt.Fprintf(&b, ".day-cell.%s, .day-half.%s { background: %s; }\n", statusClass(st.Code), statusClass(st.Code), st.Color)
+	}
+	w.Header().Set("Content-Type", "text/css; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(b.String()))
+}
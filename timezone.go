@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// 服务器默认时区，由 -tz 参数指定，未指定时为服务器本地时区
+var defaultLocation = time.Local
+
+// initDefaultLocation 设置服务器默认时区，name 为空时保持本地时区
+func initDefaultLocation(name string) error {
+	if name == "" {
+		return nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return err
+	}
+	defaultLocation = loc
+	return nil
+}
+
+// userLocation 用户设置的时区，未设置或无效时使用服务器默认时区
+func userLocation(userID int) *time.Location {
+	if name := getUserTimezone(userID); name != "" {
+		if loc, err := time.LoadLocation(name); err == nil {
+			return loc
+		}
+	}
+	return defaultLocation
+}
+
+// userNow 当前登录用户所在时区的当前时间，用于计算“今天”和默认月份
+func userNow(r *http.Request) time.Time {
+	if sess := getSession(r); sess != nil {
+		return time.Now().In(userLocation(sess.UserID))
+	}
+	return time.Now().In(defaultLocation)
+}
+
+// userToday 当前登录用户所在时区的今天（零点，UTC），用于日期计算
+func userToday(r *http.Request) time.Time {
+	now := userNow(r)
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// 设置页中可选的常用时区，也可以手动填写其他 IANA 时区名称
+var commonTimezones = []string{
+	"Asia/Shanghai", "Asia/Tokyo", "Asia/Singapore", "Asia/Kolkata",
+	"Europe/London", "Europe/Berlin", "America/New_York", "America/Los_Angeles",
+	"Australia/Sydney", "UTC",
+}